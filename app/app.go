@@ -1,12 +1,17 @@
 package app
 
 import (
-	"fmt"
+	"crypto/tls"
 	"github.com/domac/hasky/etcd"
-	"log"
+	"github.com/domac/hasky/logger"
+	"github.com/miekg/dns"
+	netcontext "golang.org/x/net/context"
 	"net"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Appd struct {
@@ -14,65 +19,224 @@ type Appd struct {
 	opts *Options
 
 	httpListener net.Listener
+	httpServer   *http.Server
+	dnsServers   []*dns.Server
 	waitGroup    WaitGroupWrapper
 
+	rootContext netcontext.Context
+	cancelFunc  netcontext.CancelFunc
+
 	exitChan chan int
 	isExit   bool
 
-	etcdRegistry *etcd.EtcdRegistry
+	etcdRegistry  *etcd.EtcdRegistry
+	namespaces    *etcd.Namespaces
+	authenticator *Authenticator
+	log           *logger.Logger
+
+	//重新加载配置, ready在Main完成后设置
+	ready      bool
+	loader     func() (*Options, error)
+	reloadLock sync.Mutex
 }
 
 func New(opts *Options) *Appd {
 	app := &Appd{
-		opts:     opts,
-		exitChan: make(chan int),
+		opts:       opts,
+		exitChan:   make(chan int),
+		namespaces: etcd.DefaultNamespaces(),
+		log:        opts.Logger.Named("app"),
 	}
-	log.Println(VerString())
+	app.rootContext, app.cancelFunc = netcontext.WithCancel(netcontext.Background())
+	app.log.Info("hasky starting", "version", VerString())
 	return app
 }
 
 func (self *Appd) SetEtcdRegistry(registry *etcd.EtcdRegistry) {
+	self.Lock()
+	defer self.Unlock()
 	self.etcdRegistry = registry
 }
 
-func (self *Appd) logf(f string, args ...interface{}) {
-	if self.opts.Logger == nil {
-		return
-	}
-	self.opts.Logger.Output(2, fmt.Sprintf(f, args...))
+//当前生效的配置, 运行中可能被Reload替换
+func (self *Appd) getOpts() *Options {
+	self.RLock()
+	defer self.RUnlock()
+	return self.opts
+}
+
+func (self *Appd) getAuthenticator() *Authenticator {
+	self.RLock()
+	defer self.RUnlock()
+	return self.authenticator
+}
+
+//启动失败, 记录原因后退出
+func (self *Appd) fatal(msg string, kv ...interface{}) {
+	self.log.Error(msg, kv...)
+	os.Exit(1)
 }
 
 //后台运行入口
 func (self *Appd) Main() {
 	ctx := &context{appd: self}
+	if err := applyLogConfig(self.opts.Logger, self.opts); err != nil {
+		self.fatal("invalid log config", "error", err)
+	}
+	namespaces, err := etcd.NewNamespaces(self.opts.EtcdPrefix, strings.Split(self.opts.Namespaces, ","))
+	if err != nil {
+		self.fatal("invalid namespaces", "error", err)
+	}
+	self.namespaces = namespaces
+	registryConfig, err := self.opts.RegistryConfig()
+	if err != nil {
+		self.fatal("invalid registry config", "error", err)
+	}
+
+	authenticator, err := LoadAuthenticator(self.opts.AuthTokenFile)
+	if err != nil {
+		self.fatal("load auth tokens failed", "file", self.opts.AuthTokenFile, "error", err)
+	}
+	if self.opts.AuthEtcdKey != "" {
+		//etcd中的令牌加载前拒绝所有请求
+		authenticator = &Authenticator{required: true}
+	}
+	self.authenticator = authenticator
+
+	//先连接etcd并创建注册中心, 之后再开始对外服务, 请求处理时注册中心总是存在
+	registry, err := etcd.NewEtcdRegistry(&etcd.ClientConfig{
+		Endpoints:  strings.Split(self.opts.EtcdEndpoint, ","),
+		CertFile:   self.opts.EtcdCertFile,
+		KeyFile:    self.opts.EtcdKeyFile,
+		CAFile:     self.opts.EtcdCAFile,
+		Username:   self.opts.EtcdUsername,
+		Password:   self.opts.EtcdPassword,
+		Namespaces: namespaces,
+		Logger:     self.opts.Logger,
+
+		RequestTimeout: self.opts.EtcdRequestTimeout,
+		DialTimeout:    self.opts.EtcdDialTimeout,
+	})
+	if err != nil {
+		self.fatal("init etcd client failed", "endpoint", self.opts.EtcdEndpoint, "error", err)
+	}
+	if err := registry.SetConfig(registryConfig); err != nil {
+		self.fatal("invalid registry config", "error", err)
+	}
+	self.SetEtcdRegistry(registry)
+	if err := self.loadGroupDefinitions(self.opts.GroupsDir); err != nil {
+		self.fatal("load group definitions failed", "dir", self.opts.GroupsDir, "error", err)
+	}
+	self.waitGroup.Wrap(func() { self.watchGroupDefinitions() })
+	if self.opts.AuthEtcdKey != "" {
+		self.loadEtcdTokens()
+		self.waitGroup.Wrap(func() { self.refreshEtcdTokens() })
+	}
+
 	httpListener, err := net.Listen("tcp", self.opts.HTTPAddress)
 	if err != nil {
-		self.logf("FATAL: listen (%s) failed - %s", self.opts.HTTPAddress, err)
-		os.Exit(1)
+		self.fatal("listen failed", "address", self.opts.HTTPAddress, "error", err)
+	}
+	proto := "HTTP"
+	if self.opts.HTTPSCertFile != "" {
+		tlsConfig, err := newTLSConfig(self.opts.HTTPSCertFile, self.opts.HTTPSKeyFile, self.opts.HTTPSClientCAFile)
+		if err != nil {
+			self.fatal("load https certificate failed", "error", err)
+		}
+		httpListener = tls.NewListener(httpListener, tlsConfig)
+		proto = "HTTPS"
 	}
+	httpLog := self.opts.Logger.Named("http")
+	httpServer := newServer(newHTTPServer(ctx), httpLog)
 	self.Lock()
 	self.httpListener = httpListener
+	self.httpServer = httpServer
 	self.Unlock()
-	httpServer := newHTTPServer(ctx)
 	//开启对外提供的http服务
 	self.waitGroup.Wrap(func() {
-		Serve(self.httpListener, httpServer, "HTTP", self.opts.Logger)
+		Serve(httpListener, httpServer, proto, httpLog)
 	})
 
-	registry := etcd.NewEtcdRegistry(self.opts.EtcdEndpoint)
-	self.SetEtcdRegistry(registry)
+	//开启内置的DNS服务
+	if self.opts.DNSAddress != "" {
+		handler := newDNSServer(ctx)
+		udpConn, err := net.ListenPacket("udp", self.opts.DNSAddress)
+		if err != nil {
+			self.fatal("listen udp failed", "address", self.opts.DNSAddress, "error", err)
+		}
+		tcpListener, err := net.Listen("tcp", self.opts.DNSAddress)
+		if err != nil {
+			self.fatal("listen tcp failed", "address", self.opts.DNSAddress, "error", err)
+		}
+		self.dnsServers = []*dns.Server{
+			{Addr: self.opts.DNSAddress, Net: "udp", PacketConn: udpConn, Handler: handler},
+			{Addr: self.opts.DNSAddress, Net: "tcp", Listener: tcpListener, Handler: handler},
+		}
+		for _, server := range self.dnsServers {
+			server := server
+			self.waitGroup.Wrap(func() {
+				ServeDNS(server, self.opts.Logger.Named("dns"))
+			})
+		}
+	}
 
 	//启动Etcd服务发现
 	self.waitGroup.Wrap(func() { self.EtcdLookup() })
+
+	self.Lock()
+	self.ready = true
+	self.Unlock()
 }
 
+//从etcd加载令牌, 失败时保留原有的令牌
+func (self *Appd) loadEtcdTokens() {
+	key := self.namespaces.Key(self.getOpts().AuthEtcdKey)
+	data, err := self.etcdRegistry.GetValue(key)
+	var authenticator *Authenticator
+	if err == nil {
+		authenticator, err = ParseAuthenticator(data)
+	}
+	if err != nil {
+		self.log.Error("load auth tokens from etcd failed", "key", key, "error", err)
+		return
+	}
+	self.Lock()
+	self.authenticator = authenticator
+	self.Unlock()
+}
+
+//定期从etcd重新加载令牌
+func (self *Appd) refreshEtcdTokens() {
+	interval := func() time.Duration { return self.getOpts().AuthRefreshInterval }
+	etcd.TickEvery(self.rootContext, interval, func(time.Duration) { self.loadEtcdTokens() })
+}
+
+//停止服务, 所有后台任务结束后返回
 func (self *Appd) Exit() {
-	if self.httpListener != nil {
-		self.httpListener.Close()
+	self.RLock()
+	httpServer := self.httpServer
+	registry := self.etcdRegistry
+	opts := self.opts
+	self.RUnlock()
+	if httpServer != nil {
+		Shutdown(httpServer, opts.HTTPDrainTimeout, opts.Logger.Named("http"))
+	}
+
+	for _, server := range self.dnsServers {
+		//服务还未开始时直接关闭监听, 让ActivateAndServe返回
+		if err := server.Shutdown(); err != nil {
+			if server.PacketConn != nil {
+				server.PacketConn.Close()
+			}
+			if server.Listener != nil {
+				server.Listener.Close()
+			}
+		}
 	}
 
-	if self.etcdRegistry != nil {
-		self.etcdRegistry.Close()
+	self.cancelFunc()
+	if registry != nil {
+		registry.Close()
 	}
 	close(self.exitChan)
 	self.isExit = true
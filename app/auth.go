@@ -0,0 +1,275 @@
+package app
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/domac/hasky/etcd"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"path"
+	"strings"
+)
+
+//API角色, 没有配置actions时按角色授予操作: read只能查看, admin拥有所有操作
+type Role string
+
+const (
+	ROLE_READ  Role = "read"
+	ROLE_ADMIN Role = "admin"
+)
+
+//API操作
+type Action string
+
+const (
+	ACTION_VIEW        Action = "view"        //查看组与成员的状态
+	ACTION_PROMOTE     Action = "promote"     //指定成员成为leader
+	ACTION_SWITCH      Action = "switch"      //按规则切换leader
+	ACTION_UPDATE      Action = "update"      //更新agent
+	ACTION_MAINTENANCE Action = "maintenance" //设置成员的维护状态, 对所有组有效时可访问pprof
+)
+
+var allActions = []Action{ACTION_VIEW, ACTION_PROMOTE, ACTION_SWITCH, ACTION_UPDATE, ACTION_MAINTENANCE}
+
+//API令牌, groups为组名的匹配模式(path.Match), 为空或包含"*"时对所有组有效
+type Token struct {
+	Name    string   `toml:"name"`
+	Token   string   `toml:"token"`
+	Role    Role     `toml:"role"`
+	Groups  []string `toml:"groups"`
+	Actions []Action `toml:"actions"`
+}
+
+//令牌文件的格式
+type tokenFile struct {
+	Tokens []*Token `toml:"token"`
+}
+
+//令牌认证, 没有配置令牌时不做认证
+type Authenticator struct {
+	tokens []*Token
+	//令牌来自etcd且尚未加载时拒绝所有请求
+	required bool
+}
+
+//从toml文件加载令牌, 文件为空时返回不做认证的Authenticator
+func LoadAuthenticator(file string) (*Authenticator, error) {
+	if file == "" {
+		return &Authenticator{}, nil
+	}
+	var tf tokenFile
+	if _, err := toml.DecodeFile(file, &tf); err != nil {
+		return nil, err
+	}
+	return newAuthenticator(tf.Tokens)
+}
+
+//解析etcd中保存的令牌, 格式与令牌文件相同
+func ParseAuthenticator(data string) (*Authenticator, error) {
+	var tf tokenFile
+	if _, err := toml.Decode(data, &tf); err != nil {
+		return nil, err
+	}
+	auth, err := newAuthenticator(tf.Tokens)
+	if err != nil {
+		return nil, err
+	}
+	auth.required = true
+	return auth, nil
+}
+
+func newAuthenticator(tokens []*Token) (*Authenticator, error) {
+	names := make(map[string]bool)
+	for i, t := range tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("token #%d (%s) is empty", i, t.Name)
+		}
+		if t.Role != ROLE_READ && t.Role != ROLE_ADMIN && (t.Role != "" || len(t.Actions) == 0) {
+			return nil, fmt.Errorf("token %s has invalid role %q", t.Name, t.Role)
+		}
+		for _, action := range t.Actions {
+			if !validAction(action) {
+				return nil, fmt.Errorf("token %s has invalid action %q", t.Name, action)
+			}
+		}
+		for _, pattern := range t.Groups {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("token %s has invalid group pattern %q", t.Name, pattern)
+			}
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate token name %s", t.Name)
+		}
+		names[t.Name] = true
+	}
+	return &Authenticator{tokens: tokens}, nil
+}
+
+func validAction(action Action) bool {
+	for _, a := range allActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) Enabled() bool {
+	return a.required || len(a.tokens) > 0
+}
+
+//按令牌查找, 逐个做常量时间比较
+func (a *Authenticator) lookup(value string) *Token {
+	var found *Token
+	for _, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(value)) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+//从请求头中取出令牌: Authorization: Bearer <token> 或者 X-Hasky-Token: <token>
+func requestToken(req *http.Request) string {
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return req.Header.Get("X-Hasky-Token")
+}
+
+//令牌是否拥有该操作
+func (t *Token) can(action Action) bool {
+	if len(t.Actions) == 0 {
+		return t.Role == ROLE_ADMIN || action == ACTION_VIEW
+	}
+	for _, a := range t.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+//令牌是否对所有组有效
+func (t *Token) global() bool {
+	if len(t.Groups) == 0 {
+		return true
+	}
+	for _, pattern := range t.Groups {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//令牌是否对所有组拥有所有操作
+func (t *Token) admin() bool {
+	for _, action := range allActions {
+		if !t.can(action) {
+			return false
+		}
+	}
+	return t.global()
+}
+
+//令牌是否对该组有效, name为组的短名称
+func (t *Token) inScope(name string) bool {
+	if t.global() {
+		return true
+	}
+	for _, pattern := range t.Groups {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//请求对各组是否有该操作的权限, 用于在列表中过滤掉无权查看的组, 允许传入组名或完整路径
+func (a *Authenticator) scope(req *http.Request, action Action, namespaces *etcd.Namespaces) func(group string) bool {
+	if !a.Enabled() {
+		return func(string) bool { return true }
+	}
+	token := a.lookup(requestToken(req))
+	return func(group string) bool {
+		return token != nil && token.can(action) && token.inScope(groupName(namespaces, group))
+	}
+}
+
+//请求是否来自管理员, 不做认证时总是true
+func (a *Authenticator) admin(req *http.Request) bool {
+	if !a.Enabled() {
+		return true
+	}
+	token := a.lookup(requestToken(req))
+	return token != nil && token.admin()
+}
+
+func groupName(namespaces *etcd.Namespaces, group string) string {
+	return namespaces.GroupName(namespaces.GroupPath(group))
+}
+
+//按操作与组授权, 需要放在Log之前以便记录认证失败的状态码
+//请求带有group参数时检查令牌对该组的权限; 不带group的列表接口由handler按scope过滤
+func Authorize(ctx *context, action Action) Decorator {
+	return authorize(ctx, action, false)
+}
+
+//与Authorize相同, 但要求令牌对所有组有效, 用于与组无关的接口
+func AuthorizeGlobal(ctx *context, action Action) Decorator {
+	return authorize(ctx, action, true)
+}
+
+//要求令牌对所有组拥有所有操作, 用于可以读出令牌或者写入任意key的接口
+func AuthorizeAdmin(ctx *context) Decorator {
+	global := AuthorizeGlobal(ctx, ACTION_MAINTENANCE)
+	return func(f APIHandler) APIHandler {
+		return global(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			if !ctx.appd.getAuthenticator().admin(req) {
+				return nil, Result{403, false, "FORBIDDEN", nil}
+			}
+			return f(w, req, ps)
+		})
+	}
+}
+
+func authorize(ctx *context, action Action, global bool) Decorator {
+	return func(f APIHandler) APIHandler {
+		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+			auth := ctx.appd.getAuthenticator()
+			if !auth.Enabled() {
+				return f(w, req, ps)
+			}
+			token := auth.lookup(requestToken(req))
+			if token == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="hasky"`)
+				return nil, Result{401, false, "UNAUTHORIZED", nil}
+			}
+			if !token.can(action) || (global && !token.global()) {
+				return nil, Result{403, false, "FORBIDDEN", nil}
+			}
+			//组名包含"/"或".."时无法按模式判断权限, 直接拒绝
+			if group := req.URL.Query().Get("group"); group != "" {
+				if ctx.appd.namespaces.CheckGroup(group) != nil {
+					return nil, Result{400, false, "INVALID_ARG_GROUP", nil}
+				}
+				if !token.inScope(groupName(ctx.appd.namespaces, group)) {
+					return nil, Result{403, false, "FORBIDDEN", nil}
+				}
+			}
+			return f(w, req, ps)
+		}
+	}
+}
+
+//handler自行输出响应, 只在出错时输出错误信息
+func Raw(f APIHandler) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		if _, err := f(w, req, ps); err != nil {
+			RespondDefault(w, err.(Result).Code, err)
+		}
+		return nil, nil
+	}
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+)
+
+const testTokens = `
+[[token]]
+name = "ops"
+token = "ops-token"
+role = "admin"
+
+[[token]]
+name = "team-a"
+token = "team-a-token"
+groups = ["team-a-*"]
+actions = ["view", "maintenance"]
+
+[[token]]
+name = "maintainer"
+token = "maintainer-token"
+actions = ["view", "maintenance"]
+
+[[token]]
+name = "team-a-admin"
+token = "team-a-admin-token"
+role = "admin"
+groups = ["team-a-*"]
+
+[[token]]
+name = "reader"
+token = "reader-token"
+role = "read"
+`
+
+//使用内存后端与etcd中的令牌创建http服务
+func newTestServer(t *testing.T) (*httpServer, etcd.Backend) {
+	opts := NewOptions()
+	opts.Logger = logger.New(ioutil.Discard, logger.FORMAT_LOGFMT)
+	appd := New(opts)
+	auth, err := ParseAuthenticator(testTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appd.authenticator = auth
+	backend := etcd.NewMemoryBackend()
+	registry := etcd.NewEtcdRegistryWithBackend(backend)
+	registry.SetLogger(opts.Logger)
+	appd.SetEtcdRegistry(registry)
+	return newHTTPServer(&context{appd: appd}), backend
+}
+
+func serve(s *httpServer, method, url, token string) int {
+	req := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w.Code
+}
+
+//令牌按操作与组的模式授权
+func TestTokenScope(t *testing.T) {
+	auth, err := ParseAuthenticator(testTokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaces := etcd.DefaultNamespaces()
+	team := auth.lookup("team-a-token")
+	cases := []struct {
+		token  *Token
+		action Action
+		group  string
+		want   bool
+	}{
+		{team, ACTION_VIEW, "team-a-x", true},
+		{team, ACTION_MAINTENANCE, "/hasky/agent-groups/team-a-x", true},
+		{team, ACTION_MAINTENANCE, "team-b-x", false},
+		{team, ACTION_SWITCH, "team-a-x", false},
+		{team, ACTION_VIEW, "team-a-x/../team-b-x", false},
+		{auth.lookup("reader-token"), ACTION_VIEW, "team-b-x", true},
+		{auth.lookup("reader-token"), ACTION_MAINTENANCE, "team-b-x", false},
+		{auth.lookup("ops-token"), ACTION_PROMOTE, "team-b-x", true},
+	}
+	for _, c := range cases {
+		if got := c.token.can(c.action) && c.token.inScope(groupName(namespaces, c.group)); got != c.want {
+			t.Errorf("%s %s %s = %v, want %v", c.token.Name, c.action, c.group, got, c.want)
+		}
+	}
+	if team.global() || !auth.lookup("ops-token").global() || auth.lookup("nope") != nil {
+		t.Error("global scope or lookup mismatch")
+	}
+}
+
+//组与成员名中的".."不能让维护操作写到授权的组之外
+func TestMemberAdminPathTraversal(t *testing.T) {
+	s, backend := newTestServer(t)
+	dir := etcd.DefaultNamespaces().Dirs()[0]
+	backend.Set(dir+"/team-a-x/members/agent-1/heartbeat", "agent-hb-1")
+	backend.Set(dir+"/team-b/members/x/heartbeat", "agent-hb-1")
+
+	cases := []struct {
+		url  string
+		code int
+	}{
+		{"/member/disable?group=team-a-x&member=../../team-b/members/x", 400},
+		{"/member/disable?group=team-a-x&member=..", 400},
+		{"/member/disable?group=team-a-x/../team-b&member=x", 400},
+		{"/member/disable?group=" + dir + "/team-a-x/../team-b&member=x", 400},
+		{"/member/disable?group=team-b&member=x", 403},
+		{"/member/disable?group=team-a-x&member=agent-1", 200},
+	}
+	for _, c := range cases {
+		if code := serve(s, "POST", c.url, "team-a-token"); code != c.code {
+			t.Errorf("POST %s = %d, want %d", c.url, code, c.code)
+		}
+	}
+	if backend.IsFileExist(dir + "/team-b/members/x/state") {
+		t.Fatal("team-a token changed the state of a team-b member")
+	}
+	if state, _ := backend.Get(dir + "/team-a-x/members/agent-1/state"); state != string(etcd.STATE_DISABLED) {
+		t.Fatalf("team-a member state = %q", state)
+	}
+	if code := serve(s, "POST", "/member/enable?group=team-a-x&member=agent-1", ""); code != 401 {
+		t.Errorf("request without token = %d, want 401", code)
+	}
+}
+
+//快照可以读出或写入令牌, 导入与导出令牌只允许管理员
+func TestSnapshotRequiresAdmin(t *testing.T) {
+	s, backend := newTestServer(t)
+	backend.Set("/hasky/auth/tokens", testTokens)
+	cases := []struct {
+		method, url, token string
+		code               int
+	}{
+		{"GET", "/snapshot", "maintainer-token", 200},
+		{"GET", "/snapshot?include_secrets=true", "maintainer-token", 403},
+		{"POST", "/snapshot", "maintainer-token", 403},
+		{"GET", "/snapshot", "team-a-admin-token", 403},
+		{"POST", "/snapshot", "team-a-admin-token", 403},
+		{"GET", "/snapshot?include_secrets=true", "ops-token", 200},
+		{"POST", "/snapshot", "ops-token", 400},
+	}
+	for _, c := range cases {
+		if code := serve(s, c.method, c.url, c.token); code != c.code {
+			t.Errorf("%s %s with %s = %d, want %d", c.method, c.url, c.token, code, c.code)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+//读取groups-dir中的组定义并交给注册中心, 目录为空时清除所有声明
+func (self *Appd) loadGroupDefinitions(dir string) error {
+	if dir == "" {
+		return self.etcdRegistry.SetGroupDefinitions(nil)
+	}
+	defs, err := etcd.LoadGroupDefinitions(dir)
+	if err != nil {
+		return err
+	}
+	return self.etcdRegistry.SetGroupDefinitions(defs)
+}
+
+//groups-dir中定义文件的指纹, 文件新增、删除或修改后发生变化
+func groupsFingerprint(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.toml"))
+	sort.Strings(files)
+	fingerprint := dir
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		fingerprint += fmt.Sprintf("|%s:%d:%d", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return fingerprint
+}
+
+//定期检查groups-dir, 定义文件变化后重新加载; 加载失败时保留原有的声明
+//目录在每次检查时重新读取, 重新加载配置后生效
+func (self *Appd) watchGroupDefinitions() {
+	last := groupsFingerprint(self.getOpts().GroupsDir)
+	interval := func() time.Duration { return self.getOpts().GroupsSyncInterval }
+	etcd.TickEvery(self.rootContext, interval, func(time.Duration) {
+		dir := self.getOpts().GroupsDir
+		fingerprint := groupsFingerprint(dir)
+		if fingerprint == last {
+			return
+		}
+		last = fingerprint
+		if err := self.loadGroupDefinitions(dir); err != nil {
+			self.log.Error("load group definitions failed, keep the previous ones", "dir", dir, "error", err)
+			return
+		}
+		self.log.Info("group definitions reloaded", "dir", dir)
+	})
+}
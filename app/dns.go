@@ -0,0 +1,211 @@
+package app
+
+import (
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"github.com/miekg/dns"
+	"hash/fnv"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const DNS_TTL uint32 = 5
+
+//内置DNS服务
+//leader.<group>.<domain>   -> 当前leader的A记录
+//<group>.<domain>          -> 健康成员的A/SRV记录
+//<member>.<group>.<domain> -> 成员的A记录, <member>见memberLabel
+//默认命名空间之外的组, <group>写作 <group>.<namespace>
+type dnsServer struct {
+	ctx    *context
+	domain string
+}
+
+func newDNSServer(ctx *context) *dnsServer {
+	return &dnsServer{
+		ctx:    ctx,
+		domain: dns.Fqdn(strings.ToLower(ctx.appd.opts.DNSDomain)),
+	}
+}
+
+//dns服务
+func ServeDNS(server *dns.Server, l *logger.Logger) {
+	l.Info("listening", "net", server.Net, "address", server.Addr)
+	err := server.ActivateAndServe()
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		l.Error("serve failed", "net", server.Net, "error", err)
+	}
+	l.Info("closing", "net", server.Net, "address", server.Addr)
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	found := false
+	for _, q := range r.Question {
+		if s.answer(m, q) {
+			found = true
+		}
+	}
+	if !found {
+		m.Rcode = dns.RcodeNameError
+	}
+	w.WriteMsg(m)
+}
+
+//应答单个查询, 返回名称是否存在
+func (s *dnsServer) answer(m *dns.Msg, q dns.Question) bool {
+	name := strings.ToLower(q.Name)
+	if !strings.HasSuffix(name, "."+s.domain) {
+		return false
+	}
+	label := strings.TrimSuffix(name, "."+s.domain)
+	registry := s.ctx.appd.etcdRegistry
+	if registry == nil {
+		return false
+	}
+
+	//<group>.<domain>
+	if w := lookupGroup(registry, label); w != nil {
+		for _, member := range w.Members {
+			if !member.Healthy {
+				continue
+			}
+			s.addMember(m, q, q.Name, member)
+		}
+		return true
+	}
+
+	idx := strings.Index(label, ".")
+	if idx < 0 {
+		return false
+	}
+	w := lookupGroup(registry, label[idx+1:])
+	if w == nil {
+		return false
+	}
+
+	//leader.<group>.<domain>
+	if label[:idx] == "leader" {
+		for _, member := range w.Members {
+			if member.Name == w.WorkingNode {
+				s.addMember(m, q, q.Name, member)
+				return true
+			}
+		}
+		return false
+	}
+
+	//<member>.<group>.<domain>
+	for _, member := range w.Members {
+		if memberLabel(member.Name) == label[:idx] {
+			s.addMember(m, q, q.Name, member)
+			return true
+		}
+	}
+	return false
+}
+
+//按名称查找组: <group> 或者 <group>.<namespace>
+func lookupGroup(registry *etcd.EtcdRegistry, label string) *etcd.WorkerSnapshot {
+	if w := registry.GetWorkerSnapshot(label); w != nil {
+		return w
+	}
+	if idx := strings.LastIndex(label, "."); idx > 0 {
+		return registry.GetWorkerSnapshot(label[idx+1:] + "/" + label[:idx])
+	}
+	return nil
+}
+
+//组名对应的域名: <namespace>/<group> 写作 <group>.<namespace>
+func groupLabel(group string) string {
+	group = strings.ToLower(group)
+	if idx := strings.Index(group, "/"); idx >= 0 {
+		return group[idx+1:] + "." + group[:idx]
+	}
+	return group
+}
+
+//成员名对应的DNS标签: 合法的标签转为小写后使用
+//agent常以地址注册(10.0.0.5, host:8080), 这类名称把非法字符替换为'-'并加上名称的哈希以免冲突, 如 10-0-0-5-dabeb841
+func memberLabel(name string) string {
+	name = strings.ToLower(name)
+	if validLabel(name) {
+		return name
+	}
+	clean := strings.Trim(strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name), "-")
+	if len(clean) > 54 {
+		clean = clean[:54]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	if clean == "" {
+		return fmt.Sprintf("m-%08x", h.Sum32())
+	}
+	return fmt.Sprintf("%s-%08x", clean, h.Sum32())
+}
+
+//只包含小写字母、数字与'-', 不以'-'开头或结尾, 不超过63个字符
+func validLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+//按查询类型追加成员的A/SRV记录
+func (s *dnsServer) addMember(m *dns.Msg, q dns.Question, name string, member *etcd.MemberInfo) {
+	host, port := memberHostPort(member)
+	ip := net.ParseIP(host)
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeANY:
+		if ip == nil || ip.To4() == nil {
+			return
+		}
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: DNS_TTL},
+			A:   ip.To4(),
+		})
+	case dns.TypeSRV:
+		target := dns.Fqdn(fmt.Sprintf("%s.%s.%s", memberLabel(member.Name), groupLabel(member.Group), s.domain))
+		m.Answer = append(m.Answer, &dns.SRV{
+			Hdr:      dns.RR_Header{Name: name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: DNS_TTL},
+			Priority: 10,
+			Weight:   10,
+			Port:     port,
+			Target:   target,
+		})
+		if ip != nil && ip.To4() != nil {
+			m.Extra = append(m.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: DNS_TTL},
+				A:   ip.To4(),
+			})
+		}
+	}
+}
+
+//成员地址, 优先使用元数据中的地址与端口
+func memberHostPort(member *etcd.MemberInfo) (string, uint16) {
+	endpoint := member.Meta.Endpoint(member.Name)
+	host, portStr, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return endpoint, 0
+	}
+	port, _ := strconv.ParseUint(portStr, 10, 16)
+	return host, uint16(port)
+}
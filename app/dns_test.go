@@ -0,0 +1,97 @@
+package app
+
+import (
+	"github.com/miekg/dns"
+	netcontext "golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func TestMemberLabel(t *testing.T) {
+	cases := map[string]string{
+		"agent-01": "agent-01",
+		"Agent-01": "agent-01",
+		"10.0.0.5": "10-0-0-5-dabeb841",
+	}
+	for name, want := range cases {
+		if got := memberLabel(name); got != want {
+			t.Errorf("memberLabel(%q) = %q, want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"10.0.0.5", "host:8080", "-agent", "::1", "a.b.c.d.e.f.g.h.i.j.k.l.m.n.o.p.q.r.s.t.u.v.w.x.y.z.0.1.2.3.4.5.6.7.8.9"} {
+		if label := memberLabel(name); !validLabel(label) {
+			t.Errorf("memberLabel(%q) = %q is not a valid label", name, label)
+		}
+	}
+	if memberLabel("10.0.0.5") == memberLabel("10-0-0-5") {
+		t.Error("distinct members map to the same label")
+	}
+}
+
+//以地址注册的成员, SRV记录的target可以解析到成员的A记录
+func TestDNSAddressMembers(t *testing.T) {
+	s, backend := newTestServer(t)
+	appd := s.ctx.appd
+	appd.opts.DNSDomain = "hasky."
+	group := appd.namespaces.Dirs()[0] + "/web"
+	members := map[string]string{
+		"10.0.0.5":  "",
+		"host:8080": `{"address":"10.0.0.6","port":8080}`,
+	}
+	for name, meta := range members {
+		if meta != "" {
+			backend.Set(group+"/members/"+name+"/meta", meta)
+		}
+	}
+	appd.etcdRegistry.Start(netcontext.Background())
+	defer appd.etcdRegistry.Close()
+	//第二次写入心跳后成员变为healthy
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for name := range members {
+			backend.Set(group+"/members/"+name+"/heartbeat", "agent-hb-1")
+		}
+		healthy := 0
+		if w := appd.etcdRegistry.GetWorkerSnapshot("web"); w != nil {
+			for _, m := range w.Members {
+				if m.Healthy {
+					healthy++
+				}
+			}
+		}
+		if healthy == len(members) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("members did not become healthy")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	server := newDNSServer(s.ctx)
+	m := new(dns.Msg)
+	if !server.answer(m, dns.Question{Name: "web.hasky.", Qtype: dns.TypeSRV, Qclass: dns.ClassINET}) || len(m.Answer) != 2 {
+		t.Fatalf("SRV answer = %v", m.Answer)
+	}
+	want := map[string]string{
+		"10.0.0.5":  "10.0.0.5",
+		"host:8080": "10.0.0.6",
+	}
+	for _, rr := range m.Answer {
+		target := rr.(*dns.SRV).Target
+		a := new(dns.Msg)
+		if !server.answer(a, dns.Question{Name: target, Qtype: dns.TypeA, Qclass: dns.ClassINET}) || len(a.Answer) != 1 {
+			t.Fatalf("target %s does not resolve: %v", target, a.Answer)
+		}
+		ip := a.Answer[0].(*dns.A).A.String()
+		found := false
+		for name, addr := range want {
+			if target == memberLabel(name)+".web.hasky." && ip == addr {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("target %s resolved to %s", target, ip)
+		}
+	}
+}
@@ -1,6 +1,25 @@
 package app
 
-//日志器接口
-type Logger interface {
-	Output(maxdepth int, s string) error
+import (
+	"github.com/domac/hasky/logger"
+)
+
+//按配置设置日志的默认级别、各组件的级别与输出格式, 启动与重新加载配置时调用
+func applyLogConfig(l *logger.Logger, opts *Options) error {
+	level, err := logger.ParseLevel(opts.LogLevel)
+	if err != nil {
+		return err
+	}
+	levels, err := logger.ParseLevels(opts.LogLevels)
+	if err != nil {
+		return err
+	}
+	format, err := logger.ParseFormat(opts.LogFormat)
+	if err != nil {
+		return err
+	}
+	l.SetLevel(level)
+	l.SetLevels(levels)
+	l.SetFormat(format)
+	return nil
 }
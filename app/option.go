@@ -1,21 +1,369 @@
 package app
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"net"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
-//配置选项
+//配置选项, 配置文件中的key为flag名称中的'-'替换为'_'
 type Options struct {
-	HTTPAddress  string `flag:"http-address"`
+	HTTPAddress      string        `flag:"http-address"`
+	HTTPDrainTimeout time.Duration `flag:"http-drain-timeout"`
+
+	HTTPSCertFile       string        `flag:"https-cert"`
+	HTTPSKeyFile        string        `flag:"https-key"`
+	HTTPSClientCAFile   string        `flag:"https-client-cacert"`
+	AuthTokenFile       string        `flag:"auth-token-file"`
+	AuthEtcdKey         string        `flag:"auth-etcd-key"`
+	AuthRefreshInterval time.Duration `flag:"auth-refresh-interval"`
+
 	EtcdEndpoint string `flag:"etcd-endpoint"`
-	Logger       Logger
+	EtcdPrefix   string `flag:"etcd-prefix"`
+	Namespaces   string `flag:"namespaces"`
+	EtcdCertFile string `flag:"etcd-cert"`
+	EtcdKeyFile  string `flag:"etcd-key"`
+	EtcdCAFile   string `flag:"etcd-cacert"`
+	EtcdUsername string `flag:"etcd-username"`
+	EtcdPassword string `flag:"etcd-password"`
+	DNSAddress   string `flag:"dns-address"`
+	DNSDomain    string `flag:"dns-domain"`
+
+	GroupsDir          string        `flag:"groups-dir"`
+	GroupsSyncInterval time.Duration `flag:"groups-sync-interval"`
+
+	EtcdRequestTimeout   time.Duration `flag:"etcd-request-timeout"`
+	EtcdDialTimeout      time.Duration `flag:"etcd-dial-timeout"`
+	EtcdAutoSyncInterval time.Duration `flag:"etcd-auto-sync-interval"`
+	ReconcileInterval    time.Duration `flag:"reconcile-interval"`
+	WatchRetryMin        time.Duration `flag:"watch-retry-min"`
+	WatchRetryMax        time.Duration `flag:"watch-retry-max"`
+
+	HeartbeatInterval      time.Duration `flag:"heartbeat-interval"`
+	MemberHeartbeatTimeout time.Duration `flag:"member-heartbeat-timeout"`
+	CheckInterval          time.Duration `flag:"check-interval"`
+	CheckConcurrency       int           `flag:"check-concurrency"`
+	DefaultGroupPolicy     string        `flag:"default-group-policy"`
+	ExecProbes             bool          `flag:"exec-probes"`
+
+	FlapWindow         time.Duration `flag:"flap-window"`
+	FlapThreshold      int           `flag:"flap-threshold"`
+	FlapQuarantineMin  time.Duration `flag:"flap-quarantine-min"`
+	FlapQuarantineMax  time.Duration `flag:"flap-quarantine-max"`
+	GroupFlapThreshold int           `flag:"group-flap-threshold"`
+	GroupDamping       time.Duration `flag:"group-damping"`
+
+	SchedulerWorkers    int `flag:"scheduler-workers"`
+	SchedulerQueueLimit int `flag:"scheduler-queue-limit"`
+
+	FailoverMaxStaleFraction float64       `flag:"failover-max-stale-fraction"`
+	GuardPingInterval        time.Duration `flag:"guard-ping-interval"`
+	GuardContactTimeout      time.Duration `flag:"guard-contact-timeout"`
+	GuardMaxFailures         int           `flag:"guard-max-failures"`
+	MassStaleWindow          time.Duration `flag:"mass-stale-window"`
+	MassStaleMinMembers      int           `flag:"mass-stale-min-members"`
+	ClockJumpTolerance       time.Duration `flag:"clock-jump-tolerance"`
+	ClockSuspectPeriod       time.Duration `flag:"clock-suspect-period"`
+
+	LogLevel  string `flag:"log-level"`
+	LogLevels string `flag:"log-levels"`
+	LogFormat string `flag:"log-format"`
+
+	Logger *logger.Logger
+}
+
+//输出配置时隐藏的选项
+var secretOptions = map[string]bool{
+	"etcd-password": true,
+}
+
+//重新加载配置时不能修改的选项, 修改后需要重启
+var restartOptions = map[string]bool{
+	"http-address":            true,
+	"https-cert":              true,
+	"https-key":               true,
+	"https-client-cacert":     true,
+	"auth-etcd-key":           true,
+	"etcd-endpoint":           true,
+	"etcd-prefix":             true,
+	"namespaces":              true,
+	"etcd-cert":               true,
+	"etcd-key":                true,
+	"etcd-cacert":             true,
+	"etcd-username":           true,
+	"etcd-password":           true,
+	"dns-address":             true,
+	"dns-domain":              true,
+	"etcd-request-timeout":    true,
+	"etcd-dial-timeout":       true,
+	"etcd-auto-sync-interval": true,
+	"check-concurrency":       true,
+	"scheduler-workers":       true,
+	"scheduler-queue-limit":   true,
 }
 
 func NewOptions() *Options {
+	cfg := etcd.DefaultConfig()
 	return &Options{
-		HTTPAddress:  "0.0.0.0:13360",
-		EtcdEndpoint: "0.0.0.0:2379",
-		Logger:       log.New(os.Stderr, "[hasky] ", log.Ldate|log.Ltime|log.Lmicroseconds),
+		HTTPAddress:      "0.0.0.0:13360",
+		HTTPDrainTimeout: 5 * time.Second,
+		EtcdEndpoint:     "0.0.0.0:2379",
+		EtcdPrefix:       etcd.DEFAULT_ETCD_PREFIX,
+		Namespaces:       etcd.DEFAULT_NAMESPACE,
+		DNSDomain:        "hasky.",
+
+		AuthRefreshInterval: 30 * time.Second,
+		GroupsSyncInterval:  10 * time.Second,
+
+		EtcdRequestTimeout:   etcd.ETCD_REQUEST_TIMEOUT,
+		EtcdDialTimeout:      etcd.ETCD_DIAL_TIMEOUT,
+		EtcdAutoSyncInterval: cfg.AutoSyncInterval,
+		ReconcileInterval:    cfg.ReconcileInterval,
+		WatchRetryMin:        cfg.WatchRetryMin,
+		WatchRetryMax:        cfg.WatchRetryMax,
+
+		HeartbeatInterval:      cfg.HeartbeatInterval,
+		MemberHeartbeatTimeout: cfg.MemberHeartbeatTimeout,
+		CheckInterval:          cfg.CheckInterval,
+		CheckConcurrency:       cfg.CheckConcurrency,
+
+		FlapWindow:         cfg.FlapWindow,
+		FlapThreshold:      cfg.FlapThreshold,
+		FlapQuarantineMin:  cfg.FlapQuarantineMin,
+		FlapQuarantineMax:  cfg.FlapQuarantineMax,
+		GroupFlapThreshold: cfg.GroupFlapThreshold,
+		GroupDamping:       cfg.GroupDamping,
+
+		SchedulerWorkers:    cfg.SchedulerWorkers,
+		SchedulerQueueLimit: cfg.SchedulerQueueLimit,
+
+		FailoverMaxStaleFraction: cfg.FailoverMaxStaleFraction,
+		GuardPingInterval:        cfg.GuardPingInterval,
+		GuardContactTimeout:      cfg.GuardContactTimeout,
+		GuardMaxFailures:         cfg.GuardMaxFailures,
+		MassStaleWindow:          cfg.MassStaleWindow,
+		MassStaleMinMembers:      cfg.MassStaleMinMembers,
+		ClockJumpTolerance:       cfg.ClockJumpTolerance,
+		ClockSuspectPeriod:       cfg.ClockSuspectPeriod,
+
+		LogLevel:  "info",
+		LogFormat: string(logger.FORMAT_LOGFMT),
+
+		Logger: logger.Default(),
+	}
+}
+
+//注册中心的参数
+func (self *Options) RegistryConfig() (*etcd.Config, error) {
+	policy, err := etcd.ParseGroupPolicy(self.DefaultGroupPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("default-group-policy is invalid: %v", err)
+	}
+	cfg := &etcd.Config{
+		AutoSyncInterval:  self.EtcdAutoSyncInterval,
+		ReconcileInterval: self.ReconcileInterval,
+		WatchRetryMin:     self.WatchRetryMin,
+		WatchRetryMax:     self.WatchRetryMax,
+
+		HeartbeatInterval:      self.HeartbeatInterval,
+		MemberHeartbeatTimeout: self.MemberHeartbeatTimeout,
+		CheckInterval:          self.CheckInterval,
+		CheckConcurrency:       self.CheckConcurrency,
+
+		DefaultPolicy: policy,
+		ExecProbes:    self.ExecProbes,
+
+		FlapWindow:         self.FlapWindow,
+		FlapThreshold:      self.FlapThreshold,
+		FlapQuarantineMin:  self.FlapQuarantineMin,
+		FlapQuarantineMax:  self.FlapQuarantineMax,
+		GroupFlapThreshold: self.GroupFlapThreshold,
+		GroupDamping:       self.GroupDamping,
+
+		GuardPingInterval:        self.GuardPingInterval,
+		GuardContactTimeout:      self.GuardContactTimeout,
+		GuardMaxFailures:         self.GuardMaxFailures,
+		FailoverMaxStaleFraction: self.FailoverMaxStaleFraction,
+		MassStaleWindow:          self.MassStaleWindow,
+		MassStaleMinMembers:      self.MassStaleMinMembers,
+		ClockJumpTolerance:       self.ClockJumpTolerance,
+		ClockSuspectPeriod:       self.ClockSuspectPeriod,
+
+		SchedulerWorkers:    self.SchedulerWorkers,
+		SchedulerQueueLimit: self.SchedulerQueueLimit,
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//启动前检查配置, 返回第一个不合法的配置及原因
+func (self *Options) Validate() error {
+	if _, _, err := net.SplitHostPort(self.HTTPAddress); err != nil {
+		return fmt.Errorf("http-address %q is invalid: %v", self.HTTPAddress, err)
+	}
+	if self.HTTPDrainTimeout < 0 {
+		return fmt.Errorf("http-drain-timeout must not be negative, got %s", self.HTTPDrainTimeout)
+	}
+	if (self.HTTPSCertFile == "") != (self.HTTPSKeyFile == "") {
+		return errors.New("https-cert and https-key must be set together")
+	}
+	if self.HTTPSClientCAFile != "" && self.HTTPSCertFile == "" {
+		return errors.New("https-client-cacert requires https-cert and https-key")
+	}
+	if self.AuthTokenFile != "" && self.AuthEtcdKey != "" {
+		return errors.New("auth-token-file and auth-etcd-key are mutually exclusive")
+	}
+	if self.AuthEtcdKey != "" && self.AuthRefreshInterval <= 0 {
+		return fmt.Errorf("auth-refresh-interval must be positive, got %s", self.AuthRefreshInterval)
+	}
+
+	if strings.TrimSpace(self.EtcdEndpoint) == "" {
+		return errors.New("etcd-endpoint must not be empty")
+	}
+	if (self.EtcdCertFile == "") != (self.EtcdKeyFile == "") {
+		return errors.New("etcd-cert and etcd-key must be set together")
+	}
+	if self.EtcdPassword != "" && self.EtcdUsername == "" {
+		return errors.New("etcd-password requires etcd-username")
+	}
+	if self.EtcdRequestTimeout <= 0 {
+		return fmt.Errorf("etcd-request-timeout must be positive, got %s", self.EtcdRequestTimeout)
+	}
+	if self.EtcdDialTimeout <= 0 {
+		return fmt.Errorf("etcd-dial-timeout must be positive, got %s", self.EtcdDialTimeout)
+	}
+	if _, err := etcd.NewNamespaces(self.EtcdPrefix, strings.Split(self.Namespaces, ",")); err != nil {
+		return err
+	}
+
+	files := []struct{ name, path string }{
+		{"https-cert", self.HTTPSCertFile},
+		{"https-key", self.HTTPSKeyFile},
+		{"https-client-cacert", self.HTTPSClientCAFile},
+		{"auth-token-file", self.AuthTokenFile},
+		{"etcd-cert", self.EtcdCertFile},
+		{"etcd-key", self.EtcdKeyFile},
+		{"etcd-cacert", self.EtcdCAFile},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("%s is not readable: %v", f.name, err)
+		}
+	}
+
+	if self.GroupsDir != "" {
+		info, err := os.Stat(self.GroupsDir)
+		if err != nil {
+			return fmt.Errorf("groups-dir is not readable: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("groups-dir %s is not a directory", self.GroupsDir)
+		}
+	}
+	if self.GroupsSyncInterval <= 0 {
+		return fmt.Errorf("groups-sync-interval must be positive, got %s", self.GroupsSyncInterval)
+	}
+
+	if self.DNSAddress != "" {
+		if _, _, err := net.SplitHostPort(self.DNSAddress); err != nil {
+			return fmt.Errorf("dns-address %q is invalid: %v", self.DNSAddress, err)
+		}
+	}
+	if !strings.HasSuffix(self.DNSDomain, ".") {
+		return fmt.Errorf("dns-domain %q must end with '.'", self.DNSDomain)
+	}
+	if _, err := logger.ParseLevel(self.LogLevel); err != nil {
+		return fmt.Errorf("log-level is invalid: %v", err)
+	}
+	if _, err := logger.ParseLevels(self.LogLevels); err != nil {
+		return fmt.Errorf("log-levels is invalid: %v", err)
+	}
+	if _, err := logger.ParseFormat(self.LogFormat); err != nil {
+		return fmt.Errorf("log-format is invalid: %v", err)
+	}
+	_, err := self.RegistryConfig()
+	return err
+}
+
+//检查配置文件中的key, 拼写错误的key会被忽略, 这里直接报错
+func (self *Options) CheckConfigKeys(cfg map[string]interface{}) error {
+	known := make(map[string]bool)
+	for _, name := range self.optionNames() {
+		known[strings.Replace(name, "-", "_", -1)] = true
+	}
+	unknown := make([]string, 0)
+	for key := range cfg {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+//所有选项的flag名称
+func (self *Options) optionNames() []string {
+	t := reflect.TypeOf(self).Elem()
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := t.Field(i).Tag.Get("flag"); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//与另一份配置相比发生变化的选项, 返回flag名称
+func (self *Options) Diff(other *Options) []string {
+	a := reflect.ValueOf(self).Elem()
+	b := reflect.ValueOf(other).Elem()
+	t := a.Type()
+	changed := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+//生效的配置, key与配置文件相同, 敏感信息被隐藏
+func (self *Options) Effective() map[string]interface{} {
+	result := make(map[string]interface{})
+	v := reflect.ValueOf(self).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("flag")
+		if name == "" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if secretOptions[name] && value != "" {
+			value = "******"
+		}
+		result[strings.Replace(name, "-", "_", -1)] = value
 	}
+	return result
 }
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//设置重新读取配置的方法, 由main根据 -config 与命令行参数重新解析
+func (self *Appd) SetConfigLoader(loader func() (*Options, error)) {
+	self.Lock()
+	defer self.Unlock()
+	self.loader = loader
+}
+
+//重新加载配置, 返回发生变化的选项
+//只能重启生效的选项(见 restartOptions)发生变化时拒绝整个重新加载, 不做任何修改
+//令牌文件或etcd中的令牌以及组定义每次都会重新读取, 即使选项没有变化
+func (self *Appd) Reload() ([]string, error) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	self.RLock()
+	ready, loader, old := self.ready, self.loader, self.opts
+	self.RUnlock()
+	if !ready {
+		return nil, errors.New("hasky is still starting, try again later")
+	}
+	if loader == nil {
+		return nil, errors.New("config reload is not supported")
+	}
+	opts, err := loader()
+	if err != nil {
+		return nil, err
+	}
+
+	changed := old.Diff(opts)
+	restart := make([]string, 0)
+	for _, name := range changed {
+		if restartOptions[name] {
+			restart = append(restart, name)
+		}
+	}
+	if len(restart) > 0 {
+		return nil, fmt.Errorf("%s cannot be changed without a restart, config not reloaded", strings.Join(restart, ", "))
+	}
+
+	registryConfig, err := opts.RegistryConfig()
+	if err != nil {
+		return nil, err
+	}
+	var authenticator *Authenticator
+	if opts.AuthEtcdKey == "" {
+		if authenticator, err = LoadAuthenticator(opts.AuthTokenFile); err != nil {
+			return nil, fmt.Errorf("load auth tokens (%s) failed - %s", opts.AuthTokenFile, err)
+		}
+	}
+	//组定义在修改其他配置之前应用, 定义有错误时不做任何修改
+	if err := self.loadGroupDefinitions(opts.GroupsDir); err != nil {
+		return nil, fmt.Errorf("load group definitions (%s) failed - %s", opts.GroupsDir, err)
+	}
+	if err := self.etcdRegistry.UpdateConfig(registryConfig); err != nil {
+		return nil, err
+	}
+	if err := applyLogConfig(old.Logger, opts); err != nil {
+		return nil, err
+	}
+
+	opts.Logger = old.Logger
+	self.Lock()
+	self.opts = opts
+	if authenticator != nil {
+		self.authenticator = authenticator
+	}
+	self.Unlock()
+	if opts.AuthEtcdKey != "" {
+		self.loadEtcdTokens()
+	}
+
+	if len(changed) > 0 {
+		self.log.Info("config reloaded", "changed", strings.Join(changed, ","))
+	} else {
+		self.log.Info("config reloaded, no option changed")
+	}
+	return changed, nil
+}
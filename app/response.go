@@ -3,6 +3,7 @@ package app
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/domac/hasky/logger"
 	"github.com/julienschmidt/httprouter"
 	"io"
 	"net/http"
@@ -127,7 +128,7 @@ func Decorate(f APIHandler, ds ...Decorator) httprouter.Handle {
 	}
 }
 
-func Log(l Logger) Decorator {
+func Log(l *logger.Logger) Decorator {
 	return func(f APIHandler) APIHandler {
 		return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			start := time.Now()
@@ -137,23 +138,23 @@ func Log(l Logger) Decorator {
 			if e, ok := err.(Result); ok {
 				status = e.Code
 			}
-			l.Output(2, fmt.Sprintf("%d %s %s (%s) %s",
-				status, req.Method, req.URL.RequestURI(), req.RemoteAddr, elapsed))
+			l.Info("request", "status", status, "method", req.Method, "uri", req.URL.RequestURI(),
+				"remote", req.RemoteAddr, "elapsed", elapsed)
 			return response, err
 		}
 	}
 }
 
-func LogPanicHandler(l Logger) func(w http.ResponseWriter, req *http.Request, p interface{}) {
+func LogPanicHandler(l *logger.Logger) func(w http.ResponseWriter, req *http.Request, p interface{}) {
 	return func(w http.ResponseWriter, req *http.Request, p interface{}) {
-		l.Output(2, fmt.Sprintf("ERROR: panic in HTTP handler - %s", p))
+		l.Error("panic in HTTP handler", "uri", req.URL.RequestURI(), "panic", p)
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Result{500, false, "INTERNAL_ERROR", nil}
 		}, Log(l), Default)(w, req, nil)
 	}
 }
 
-func LogNotFoundHandler(l Logger) http.Handler {
+func LogNotFoundHandler(l *logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Result{404, false, "NOT_FOUND", nil}
@@ -161,7 +162,7 @@ func LogNotFoundHandler(l Logger) http.Handler {
 	})
 }
 
-func LogMethodNotAllowedHandler(l Logger) http.Handler {
+func LogMethodNotAllowedHandler(l *logger.Logger) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		Decorate(func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 			return nil, Result{405, false, "METHOD_NOT_ALLOWED", nil}
@@ -3,49 +3,80 @@ package app
 import (
 	"bytes"
 	"errors"
-	log "github.com/alecthomas/log4go"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
 	"github.com/julienschmidt/httprouter"
 	"github.com/olekukonko/tablewriter"
 	"net/http"
 	"net/http/pprof"
+	"sort"
+	"strconv"
+	"time"
 )
 
 type httpServer struct {
 	ctx    *context
 	router http.Handler
+	log    *logger.Logger
 }
 
 //HTTP 服务
 func newHTTPServer(ctx *context) *httpServer {
 
-	log := Log(ctx.appd.opts.Logger)
+	l := ctx.appd.opts.Logger.Named("http")
+	log := Log(l)
 
 	router := httprouter.New()
 	router.HandleMethodNotAllowed = true
-	router.PanicHandler = LogPanicHandler(ctx.appd.opts.Logger)
-	router.NotFound = LogNotFoundHandler(ctx.appd.opts.Logger)
-	router.MethodNotAllowed = LogMethodNotAllowedHandler(ctx.appd.opts.Logger)
+	router.PanicHandler = LogPanicHandler(l)
+	router.NotFound = LogNotFoundHandler(l)
+	router.MethodNotAllowed = LogMethodNotAllowedHandler(l)
 
 	s := &httpServer{
 		ctx:    ctx,
 		router: router,
+		log:    l,
 	}
-	//内置监控
-	router.GET("/debug/pprof/*pprof", innerPprofHandler)
+	view := Authorize(ctx, ACTION_VIEW)
+	maintenance := Authorize(ctx, ACTION_MAINTENANCE)
+
+	//内置监控, 只对所有组有maintenance权限的令牌开放
+	router.GET("/debug/pprof/*pprof", Decorate(innerPprofHandler, AuthorizeGlobal(ctx, ACTION_MAINTENANCE), log, Raw))
 
 	//在这里注册路由服务
-	router.Handle("GET", "/version", Decorate(s.versionHandler, log, Default))
-	router.Handle("GET", "/workers", Decorate(s.displayWorkersHandler, log, PlainText))
-	router.Handle("GET", "/update", Decorate(s.agentUpdateHandler, log, PlainText))
+	router.Handle("GET", "/version", Decorate(s.versionHandler, view, log, Default))
+	router.Handle("GET", "/workers", Decorate(s.displayWorkersHandler, view, log, PlainText))
+	router.Handle("GET", "/groups", Decorate(s.groupsHandler, view, log, Default))
+	router.Handle("GET", "/update", Decorate(s.agentUpdateHandler, Authorize(ctx, ACTION_UPDATE), log, PlainText))
+	router.Handle("GET", "/members", Decorate(s.queryMembersHandler, view, log, Default))
+	router.Handle("GET", "/member/state", Decorate(s.memberStateHandler, view, log, Default))
+	router.Handle("POST", "/member/enable", Decorate(s.memberAdminHandler(""), maintenance, log, Default))
+	router.Handle("POST", "/member/disable", Decorate(s.memberAdminHandler(etcd.STATE_DISABLED), maintenance, log, Default))
+	router.Handle("POST", "/member/drain", Decorate(s.memberAdminHandler(etcd.STATE_DRAINING), maintenance, log, Default))
+	router.Handle("POST", "/leader/promote", Decorate(s.promoteHandler, Authorize(ctx, ACTION_PROMOTE), log, Default))
+	router.Handle("POST", "/leader/switch", Decorate(s.switchHandler, Authorize(ctx, ACTION_SWITCH), log, Default))
+	router.Handle("GET", "/metrics", Decorate(s.metricsHandler, AuthorizeGlobal(ctx, ACTION_VIEW), log, Default))
+	router.Handle("GET", "/events", Decorate(s.eventsHandler, view, log, Default))
+	router.Handle("GET", "/damping", Decorate(s.dampingHandler, view, log, Default))
+	router.Handle("GET", "/guard", Decorate(s.guardHandler, AuthorizeGlobal(ctx, ACTION_VIEW), log, Default))
+	router.Handle("GET", "/config", Decorate(s.configHandler, AuthorizeGlobal(ctx, ACTION_VIEW), log, Default))
+	router.Handle("POST", "/config/reload", Decorate(s.reloadHandler, AuthorizeGlobal(ctx, ACTION_MAINTENANCE), log, Default))
+	router.Handle("GET", "/snapshot", Decorate(s.exportSnapshotHandler, AuthorizeGlobal(ctx, ACTION_MAINTENANCE), log, Default))
+	router.Handle("POST", "/snapshot", Decorate(s.importSnapshotHandler, AuthorizeAdmin(ctx), log, Default))
 	return s
 }
 
+//请求可以查看的组
+func (s *httpServer) viewScope(req *http.Request) func(group string) bool {
+	return s.ctx.appd.getAuthenticator().scope(req, ACTION_VIEW, s.ctx.appd.namespaces)
+}
+
 func (s *httpServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	s.router.ServeHTTP(w, req)
 }
 
 //调用内置的pprof
-func innerPprofHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+func innerPprofHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) (interface{}, error) {
 	switch p.ByName("pprof") {
 	case "/cmdline":
 		pprof.Cmdline(w, r)
@@ -56,6 +87,7 @@ func innerPprofHandler(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	default:
 		pprof.Index(w, r)
 	}
+	return nil, nil
 }
 
 func (s *httpServer) versionHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
@@ -66,19 +98,71 @@ func (s *httpServer) versionHandler(w http.ResponseWriter, req *http.Request, ps
 //展示工作节点列表
 func (s *httpServer) displayWorkersHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	workers := s.ctx.appd.etcdRegistry.GetWorkers()
+	visible := s.viewScope(req)
 
 	buff := bytes.Buffer{}
 	table := tablewriter.NewWriter(&buff)
-	table.SetHeader([]string{"worker node", "Last Keepalive"})
+	table.SetHeader([]string{"worker node", "Last Keepalive", "Last Probe Error", "member", "state", "heartbeat age"})
 
-	for group, worker := range workers {
-		data := []string{group, worker.LastKeepalive.Format("2006-01-02 15:04:05")}
-		table.Append(data)
+	groups := make([]string, 0, len(workers))
+	for group := range workers {
+		if visible(group) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	now := time.Now()
+	for _, group := range groups {
+		worker := workers[group]
+		data := []string{group, worker.LastKeepalive.Format("2006-01-02 15:04:05"), worker.LastProbeError, "", "", ""}
+		if len(worker.States) == 0 {
+			table.Append(data)
+		}
+		//每个成员一行
+		for _, status := range worker.States {
+			name := status.Name
+			if name == worker.WorkingNode {
+				name += " (leader)"
+			}
+			age := now.Sub(status.LastSeen).Truncate(time.Second).String()
+			table.Append([]string{data[0], data[1], data[2], name, string(status.State), age})
+		}
 	}
 	table.Render()
 	return buff.String(), nil
 }
 
+//所有组的leader与成员健康状况, 按组名排序
+func (s *httpServer) groupsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	namespaces := s.ctx.appd.namespaces
+	visible := s.viewScope(req)
+	result := make([]*etcd.GroupSummary, 0)
+	for group, worker := range s.ctx.appd.etcdRegistry.GetWorkers() {
+		if !visible(group) {
+			continue
+		}
+		summary := &etcd.GroupSummary{
+			Group:          namespaces.GroupName(group),
+			Leader:         worker.WorkingNode,
+			Members:        len(worker.States),
+			LastProbeError: worker.LastProbeError,
+			Declared:       s.ctx.appd.etcdRegistry.GetGroupDefinition(group) != nil,
+			MissingMembers: s.ctx.appd.etcdRegistry.MissingMembers(group),
+		}
+		for _, status := range worker.States {
+			if status.State == etcd.STATE_HEALTHY {
+				summary.Healthy++
+			}
+			if status.Name == worker.WorkingNode {
+				summary.LeaderState = status.State
+			}
+		}
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Group < result[j].Group })
+	return result, nil
+}
+
 //TODO: Agent更新
 func (s *httpServer) agentUpdateHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
 	paramReq, err := NewReqParams(req)
@@ -90,6 +174,246 @@ func (s *httpServer) agentUpdateHandler(w http.ResponseWriter, req *http.Request
 	if group == "" || agent == "" {
 		return nil, errors.New("group or agent must not be null !")
 	}
-	log.Info("update info : GROUP: %s , AGENT: %s", group, agent)
+	s.log.Info("update agent", "group", group, "agent", agent)
 	return nil, nil
 }
+
+//按 group/zone/tag/health 查询成员
+func (s *httpServer) queryMembersHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	q := &etcd.MemberQuery{}
+	q.Group, _ = paramReq.Get("group")
+	q.Zone, _ = paramReq.Get("zone")
+	q.Tags, _ = paramReq.GetAll("tag")
+	q.Health, _ = paramReq.Get("health")
+	q.State, _ = paramReq.Get("state")
+	if q.Health != "" && q.Health != "healthy" && q.Health != "unhealthy" {
+		return nil, Result{400, false, "INVALID_ARG_HEALTH", nil}
+	}
+
+	members, err := s.ctx.appd.etcdRegistry.QueryMembers(q)
+	if err != nil {
+		return nil, Result{500, false, err.Error(), nil}
+	}
+	visible := s.viewScope(req)
+	result := members[:0]
+	for _, m := range members {
+		if visible(m.Group) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+//运行指标, 包含所有组的统计, 只允许对所有组有view权限的令牌访问
+func (s *httpServer) metricsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.appd.etcdRegistry.Metrics().Snapshot(), nil
+}
+
+//最近的注册中心事件, 支持 since/group/limit 参数
+func (s *httpServer) eventsHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	var since uint64
+	if v, err := paramReq.Get("since"); err == nil {
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, Result{400, false, "INVALID_ARG_SINCE", nil}
+		}
+	}
+	limit := 0
+	if v, err := paramReq.Get("limit"); err == nil {
+		if limit, err = strconv.Atoi(v); err != nil {
+			return nil, Result{400, false, "INVALID_ARG_LIMIT", nil}
+		}
+	}
+	group, _ := paramReq.Get("group")
+	visible := s.viewScope(req)
+	events := s.ctx.appd.etcdRegistry.Events().List(since, group, 0)
+	result := events[:0]
+	for _, e := range events {
+		//与组无关的事件对所有令牌可见
+		if e.Group == "" || visible(e.Group) {
+			result = append(result, e)
+		}
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result, nil
+}
+
+//组的切换抑制与成员的隔离状态, 不指定group时返回所有组
+func (s *httpServer) dampingHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	group, _ := paramReq.Get("group")
+	visible := s.viewScope(req)
+	statuses := s.ctx.appd.etcdRegistry.GetDamping(group)
+	result := statuses[:0]
+	for _, status := range statuses {
+		if visible(status.Group) {
+			result = append(result, status)
+		}
+	}
+	return result, nil
+}
+
+//切换保护的状态, 包含所有组的失效成员统计, 只允许对所有组有view权限的令牌访问
+func (s *httpServer) guardHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.appd.etcdRegistry.GuardStatus(), nil
+}
+
+//生效的配置
+func (s *httpServer) configHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	return s.ctx.appd.getOpts().Effective(), nil
+}
+
+//重新加载配置文件, 返回发生变化的选项
+func (s *httpServer) reloadHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	changed, err := s.ctx.appd.Reload()
+	if err != nil {
+		return nil, Result{400, false, err.Error(), nil}
+	}
+	return map[string]interface{}{"changed": changed}, nil
+}
+
+//导出prefix下所有key的快照, heartbeats=true 时包含心跳, include_secrets=true 时包含令牌
+//只允许全局维护权限访问, 导出令牌需要管理员
+func (s *httpServer) exportSnapshotHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	heartbeats, _ := paramReq.Get("heartbeats")
+	secrets, _ := paramReq.Get("include_secrets")
+	if (secrets == "true" || secrets == "1") && !s.ctx.appd.getAuthenticator().admin(req) {
+		return nil, Result{403, false, "FORBIDDEN", nil}
+	}
+	snap, err := s.ctx.appd.etcdRegistry.ExportSnapshot(heartbeats == "true" || heartbeats == "1", secrets == "true" || secrets == "1")
+	if err != nil {
+		return nil, Result{500, false, err.Error(), nil}
+	}
+	return snap, nil
+}
+
+//导入请求体中的快照, 参数 conflict=skip|overwrite|fail, dry_run=true 时只返回将要执行的修改
+//快照可以写入令牌与组策略, 只允许管理员导入
+func (s *httpServer) importSnapshotHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	conflict := etcd.CONFLICT_SKIP
+	if value, _ := paramReq.Get("conflict"); value != "" {
+		if conflict, err = etcd.ParseConflictPolicy(value); err != nil {
+			return nil, Result{400, false, "INVALID_ARG_CONFLICT", nil}
+		}
+	}
+	value, _ := paramReq.Get("dry_run")
+	dryRun := value == "true" || value == "1"
+	snap, err := etcd.ReadSnapshot(bytes.NewReader(paramReq.Body))
+	if err != nil {
+		return nil, Result{400, false, err.Error(), nil}
+	}
+	result, err := s.ctx.appd.etcdRegistry.ImportSnapshot(snap, conflict, dryRun)
+	if err != nil {
+		if result != nil && len(result.Conflicts) > 0 && conflict == etcd.CONFLICT_FAIL {
+			return nil, Result{409, false, err.Error(), nil}
+		}
+		return nil, Result{500, false, err.Error(), nil}
+	}
+	return result, nil
+}
+
+//成员状态及变迁记录, 不指定member时返回组内所有成员
+func (s *httpServer) memberStateHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	group, _ := paramReq.Get("group")
+	if group == "" {
+		return nil, Result{400, false, "MISSING_ARG_GROUP", nil}
+	}
+	worker := s.ctx.appd.etcdRegistry.GetWorkerSnapshot(group)
+	if worker == nil {
+		return nil, Result{404, false, "GROUP_NOT_FOUND", nil}
+	}
+	member, _ := paramReq.Get("member")
+	if member == "" {
+		return worker.States, nil
+	}
+	for _, status := range worker.States {
+		if status.Name == member {
+			return status, nil
+		}
+	}
+	return nil, Result{404, false, "MEMBER_NOT_FOUND", nil}
+}
+
+//管理员设置成员状态
+func (s *httpServer) memberAdminHandler(state etcd.MemberState) APIHandler {
+	return func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+		paramReq, err := NewReqParams(req)
+		if err != nil {
+			return nil, Result{400, false, "INVALID_REQUEST", nil}
+		}
+		group, _ := paramReq.Get("group")
+		member, _ := paramReq.Get("member")
+		if group == "" || member == "" {
+			return nil, Result{400, false, "MISSING_ARG_GROUP_OR_MEMBER", nil}
+		}
+		if s.ctx.appd.namespaces.CheckGroup(group) != nil || etcd.CheckName(member) != nil {
+			return nil, Result{400, false, "INVALID_ARG_GROUP_OR_MEMBER", nil}
+		}
+		if err := s.ctx.appd.etcdRegistry.SetMemberAdminState(group, member, state); err != nil {
+			return nil, Result{500, false, err.Error(), nil}
+		}
+		s.log.Info("member admin state changed", "group", group, "member", member, "state", state)
+		return "OK", nil
+	}
+}
+
+//指定成员成为leader, force=true时不检查成员状态
+func (s *httpServer) promoteHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	group, _ := paramReq.Get("group")
+	member, _ := paramReq.Get("member")
+	if group == "" || member == "" {
+		return nil, Result{400, false, "MISSING_ARG_GROUP_OR_MEMBER", nil}
+	}
+	force, _ := paramReq.Get("force")
+	if err := s.ctx.appd.etcdRegistry.PromoteMember(group, member, force == "true"); err != nil {
+		return nil, Result{409, false, err.Error(), nil}
+	}
+	s.log.Info("leader promoted", "group", group, "member", member, "force", force == "true")
+	return "OK", nil
+}
+
+//按自动切换的规则选出新的leader, 返回新leader的名称
+func (s *httpServer) switchHandler(w http.ResponseWriter, req *http.Request, ps httprouter.Params) (interface{}, error) {
+	paramReq, err := NewReqParams(req)
+	if err != nil {
+		return nil, Result{400, false, "INVALID_REQUEST", nil}
+	}
+	group, _ := paramReq.Get("group")
+	if group == "" {
+		return nil, Result{400, false, "MISSING_ARG_GROUP", nil}
+	}
+	member, err := s.ctx.appd.etcdRegistry.SwitchLeader(group)
+	if err != nil {
+		return nil, Result{409, false, err.Error(), nil}
+	}
+	s.log.Info("leader switched", "group", group, "member", member)
+	return member, nil
+}
@@ -1,34 +1,78 @@
 package app
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"github.com/domac/hasky/logger"
+	netcontext "golang.org/x/net/context"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 )
 
+//http.Server的错误日志
 type logWriter struct {
-	Logger
+	*logger.Logger
 }
 
 func (l logWriter) Write(p []byte) (int, error) {
-	l.Logger.Output(2, string(p))
+	l.Logger.Error(strings.TrimSpace(string(p)))
 	return len(p), nil
-
 }
 
-//http服务
-func Serve(listener net.Listener, handler http.Handler, proto string, l Logger) {
-	l.Output(2, fmt.Sprintf("%s: listening on %s", proto, listener.Addr()))
+//https的证书配置, 指定了clientCAFile时要求客户端提供由其签发的证书
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
 
-	server := &http.Server{
+//创建http服务, 错误日志输出到Logger
+func newServer(handler http.Handler, l *logger.Logger) *http.Server {
+	return &http.Server{
 		Handler:  handler,
-		ErrorLog: log.New(logWriter{}, "", 0)}
+		ErrorLog: log.New(logWriter{l}, "", 0)}
+}
+
+//http服务
+func Serve(listener net.Listener, server *http.Server, proto string, l *logger.Logger) {
+	l.Info("listening", "proto", proto, "address", listener.Addr())
 
 	err := server.Serve(listener)
-	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
-		l.Output(2, fmt.Sprintf("ERROR: http.Serve() - %s", err))
+	if err != nil && err != http.ErrServerClosed && !strings.Contains(err.Error(), "use of closed network connection") {
+		l.Error("serve failed", "proto", proto, "error", err)
+	}
+	l.Info("closing", "proto", proto, "address", listener.Addr())
+}
+
+//停止http服务, 在超时时间内等待请求处理完毕
+func Shutdown(server *http.Server, timeout time.Duration, l *logger.Logger) {
+	ctx, cancel := netcontext.WithTimeout(netcontext.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		l.Error("shutdown failed", "timeout", timeout, "error", err)
+		server.Close()
 	}
-	l.Output(2, fmt.Sprintf("%s: closing %s", proto, listener.Addr()))
 }
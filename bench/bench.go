@@ -0,0 +1,387 @@
+package bench
+
+import (
+	"fmt"
+	"github.com/coreos/etcd/client"
+	"github.com/domac/hasky/etcd"
+	"golang.org/x/net/context"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//压测参数
+type Config struct {
+	Groups            int           //组数量
+	Members           int           //每个组的成员数量
+	HeartbeatInterval time.Duration //成员写心跳的间隔
+	HeartbeatTtl      time.Duration //心跳的过期时间, 为0时心跳不过期
+	Warmup            time.Duration //开始注入故障前的预热时间
+	Duration          time.Duration //注入故障的持续时间
+	FailureInterval   time.Duration //每隔多久让一个组的leader停止心跳, 为0时不注入故障
+	RecoverAfter      time.Duration //故障成员多久后恢复心跳
+	Grace             time.Duration //停止注入后等待未完成切换的最长时间
+	Shards            int           //写心跳的协程数
+	Seed              int64
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Groups:            1000,
+		Members:           3,
+		HeartbeatInterval: time.Second,
+		HeartbeatTtl:      3 * time.Second,
+		Warmup:            5 * time.Second,
+		Duration:          30 * time.Second,
+		FailureInterval:   200 * time.Millisecond,
+		RecoverAfter:      10 * time.Second,
+		Grace:             15 * time.Second,
+		Shards:            8,
+		Seed:              time.Now().UnixNano(),
+	}
+}
+
+func (c *Config) validate() error {
+	if c.Groups <= 0 || c.Members <= 0 {
+		return fmt.Errorf("groups and members must be positive")
+	}
+	if c.HeartbeatInterval <= 0 || c.Duration <= 0 {
+		return fmt.Errorf("heartbeat interval and duration must be positive")
+	}
+	if c.Shards <= 0 {
+		c.Shards = 1
+	}
+	return nil
+}
+
+//模拟的agent
+type agent struct {
+	group  string
+	name   string
+	alive  int32
+	beats  uint64
+	shard  int
+	member int
+}
+
+//一次故障注入
+type failure struct {
+	group  string
+	member string
+	at     time.Time
+}
+
+//压测过程
+type runner struct {
+	cfg     *Config
+	backend *etcd.MemoryBackend
+	agents  []*agent
+	rand    *rand.Rand
+
+	//压测程序自身的操作数, 统计时从后端的操作数中扣除
+	harnessOps uint64
+
+	lock      sync.Mutex
+	pending   map[string]*failure
+	latencies []time.Duration
+	injected  int
+	recovered int
+}
+
+//压测的组位于默认命名空间
+var benchRoot = etcd.DefaultNamespaces().Dirs()[0]
+
+func groupKey(i int) string {
+	return fmt.Sprintf("%s/bench-%05d", benchRoot, i)
+}
+
+//执行压测并返回报告
+func Run(cfg *Config) (*Report, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	r := &runner{
+		cfg:     cfg,
+		backend: etcd.NewMemoryBackend(),
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+		pending: make(map[string]*failure),
+	}
+	r.populate()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var drivers sync.WaitGroup
+	for i := 0; i < cfg.Shards; i++ {
+		shard := i
+		drivers.Add(1)
+		go func() {
+			defer drivers.Done()
+			r.drive(ctx, shard)
+		}()
+	}
+	leaderWatcher, err := r.backend.CreateWatcher(benchRoot)
+	if err != nil {
+		return nil, err
+	}
+	drivers.Add(1)
+	go func() {
+		defer drivers.Done()
+		r.watchLeaders(ctx, leaderWatcher)
+	}()
+
+	//压测程序自身的协程不计入hasky
+	baseGoroutines := runtime.NumGoroutine()
+	cpuStart := cpuTime()
+	opsStart := r.backend.Ops() - atomic.LoadUint64(&r.harnessOps)
+	start := time.Now()
+
+	registry := etcd.NewEtcdRegistryWithBackend(r.backend)
+	registry.Start(ctx)
+
+	sampler := newSampler()
+	drivers.Add(1)
+	go func() {
+		defer drivers.Done()
+		sampler.run(ctx, baseGoroutines)
+	}()
+
+	sleepContext(ctx, cfg.Warmup)
+	if cfg.FailureInterval > 0 {
+		r.inject(ctx, cfg.Duration)
+		r.waitPending(ctx, cfg.Grace)
+	} else {
+		sleepContext(ctx, cfg.Duration)
+	}
+	elapsed := time.Since(start)
+	cpu := cpuTime() - cpuStart
+	ops := r.backend.Ops() - opsStart - atomic.LoadUint64(&r.harnessOps)
+	metrics := registry.Metrics().Snapshot()
+
+	registry.Close()
+	cancel()
+	drivers.Wait()
+
+	return r.report(elapsed, cpu, ops, metrics, sampler), nil
+}
+
+//初始化组与成员, 每个组的第一个成员为leader
+func (r *runner) populate() {
+	cfg := r.cfg
+	for g := 0; g < cfg.Groups; g++ {
+		group := groupKey(g)
+		r.backend.Set(group+"/leader", "m0")
+		for m := 0; m < cfg.Members; m++ {
+			a := &agent{
+				group:  group,
+				name:   fmt.Sprintf("m%d", m),
+				alive:  1,
+				shard:  (g*cfg.Members + m) % cfg.Shards,
+				member: m,
+			}
+			r.agents = append(r.agents, a)
+			r.beat(a)
+		}
+	}
+}
+
+func (r *runner) beat(a *agent) {
+	a.beats++
+	key := a.group + "/members/" + a.name + "/heartbeat"
+	//与agent的心跳格式一致: xxx-xxx-timestamp
+	value := fmt.Sprintf("bench-%d-%d-%d", a.member, time.Now().Unix(), a.beats)
+	if r.cfg.HeartbeatTtl > 0 {
+		r.backend.SetTtl(key, value, r.cfg.HeartbeatTtl)
+	} else {
+		r.backend.Set(key, value)
+	}
+	atomic.AddUint64(&r.harnessOps, 1)
+}
+
+//按心跳间隔为分片内存活的成员写心跳
+func (r *runner) drive(ctx context.Context, shard int) {
+	ticker := time.NewTicker(r.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, a := range r.agents {
+			if a.shard == shard && atomic.LoadInt32(&a.alive) == 1 {
+				r.beat(a)
+			}
+		}
+	}
+}
+
+//按固定间隔让随机组的leader停止心跳
+func (r *runner) inject(ctx context.Context, duration time.Duration) {
+	ticker := time.NewTicker(r.cfg.FailureInterval)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			return
+		case <-ticker.C:
+		}
+		group := groupKey(r.rand.Intn(r.cfg.Groups))
+		r.lock.Lock()
+		_, busy := r.pending[group]
+		r.lock.Unlock()
+		if busy {
+			continue
+		}
+		leader, err := r.backend.Get(group + "/leader")
+		atomic.AddUint64(&r.harnessOps, 1)
+		if err != nil {
+			continue
+		}
+		a := r.findAgent(group, leader)
+		if a == nil || !atomic.CompareAndSwapInt32(&a.alive, 1, 0) {
+			continue
+		}
+		r.lock.Lock()
+		r.pending[group] = &failure{group: group, member: leader, at: time.Now()}
+		r.injected++
+		r.lock.Unlock()
+		time.AfterFunc(r.cfg.RecoverAfter, func() {
+			if atomic.CompareAndSwapInt32(&a.alive, 0, 1) {
+				r.lock.Lock()
+				r.recovered++
+				r.lock.Unlock()
+			}
+		})
+	}
+}
+
+//等待已注入的故障完成切换
+func (r *runner) waitPending(ctx context.Context, grace time.Duration) {
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) && ctx.Err() == nil {
+		r.lock.Lock()
+		n := len(r.pending)
+		r.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		sleepContext(ctx, 100*time.Millisecond)
+	}
+}
+
+func (r *runner) findAgent(group, member string) *agent {
+	var index int
+	if _, err := fmt.Sscanf(group[len(benchRoot)+len("/bench-"):], "%d", &index); err != nil {
+		return nil
+	}
+	for _, a := range r.agents[index*r.cfg.Members : (index+1)*r.cfg.Members] {
+		if a.name == member {
+			return a
+		}
+	}
+	return nil
+}
+
+//观察leader的变化, 计算故障切换的耗时
+func (r *runner) watchLeaders(ctx context.Context, watcher client.Watcher) {
+	for {
+		resp, err := watcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			//事件过多导致watcher过期时重建, 并直接读取等待中的组的leader
+			if watcher, err = r.backend.CreateWatcher(benchRoot); err != nil {
+				return
+			}
+			r.lock.Lock()
+			groups := make([]string, 0, len(r.pending))
+			for group := range r.pending {
+				groups = append(groups, group)
+			}
+			r.lock.Unlock()
+			for _, group := range groups {
+				leader, err := r.backend.Get(group + "/leader")
+				atomic.AddUint64(&r.harnessOps, 1)
+				if err == nil {
+					r.leaderChanged(group, leader)
+				}
+			}
+			continue
+		}
+		if resp.Action == "set" && strings.HasSuffix(resp.Node.Key, "/leader") {
+			r.leaderChanged(strings.TrimSuffix(resp.Node.Key, "/leader"), resp.Node.Value)
+		}
+	}
+}
+
+func (r *runner) leaderChanged(group, leader string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if f, ok := r.pending[group]; ok && leader != f.member {
+		r.latencies = append(r.latencies, time.Since(f.at))
+		delete(r.pending, group)
+	}
+}
+
+//等待指定时间, ctx结束时提前返回
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+//按百分位取值, durations需已排序
+func percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	i := int(float64(len(durations)-1) * p)
+	return durations[i]
+}
+
+func (r *runner) report(elapsed, cpu time.Duration, ops uint64, metrics map[string]int64, s *sampler) *Report {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	latencies := make([]time.Duration, len(r.latencies))
+	copy(latencies, r.latencies)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	rep := &Report{
+		Groups:            r.cfg.Groups,
+		Members:           r.cfg.Members,
+		HeartbeatInterval: r.cfg.HeartbeatInterval.String(),
+		HeartbeatTtl:      r.cfg.HeartbeatTtl.String(),
+		Elapsed:           elapsed.Truncate(time.Millisecond).String(),
+		FailuresInjected:  r.injected,
+		Failovers:         len(latencies),
+		FailoversMissed:   len(r.pending),
+		Recovered:         r.recovered,
+		CPUSeconds:        cpu.Seconds(),
+		CPUPercent:        100 * cpu.Seconds() / elapsed.Seconds(),
+		GoroutinesMax:     s.maxGoroutines,
+		GoroutinesEnd:     s.lastGoroutines,
+		HeapMaxMB:         float64(s.maxHeap) / (1 << 20),
+		BackendOps:        ops,
+		BackendOpsPerSec:  float64(ops) / elapsed.Seconds(),
+		Checks:            metrics["checks.runs"],
+		Resyncs:           metrics["discovery.runs"] - 1,
+	}
+	if len(latencies) > 0 {
+		rep.LatencyP50 = percentile(latencies, 0.5).String()
+		rep.LatencyP90 = percentile(latencies, 0.9).String()
+		rep.LatencyP99 = percentile(latencies, 0.99).String()
+		rep.LatencyMax = latencies[len(latencies)-1].String()
+	}
+	return rep
+}
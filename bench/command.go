@@ -0,0 +1,47 @@
+package bench
+
+import (
+	"flag"
+	"fmt"
+	"github.com/domac/hasky/logger"
+	"os"
+)
+
+//hasky bench 子命令, 返回进程退出码
+func Main(args []string) int {
+	cfg := DefaultConfig()
+	flagSet := flag.NewFlagSet("hasky bench", flag.ExitOnError)
+	flagSet.IntVar(&cfg.Groups, "groups", cfg.Groups, "number of simulated groups")
+	flagSet.IntVar(&cfg.Members, "members", cfg.Members, "number of members per group")
+	flagSet.DurationVar(&cfg.HeartbeatInterval, "heartbeat", cfg.HeartbeatInterval, "heartbeat interval of each member")
+	flagSet.DurationVar(&cfg.HeartbeatTtl, "heartbeat-ttl", cfg.HeartbeatTtl, "heartbeat ttl, 0 means heartbeats never expire")
+	flagSet.DurationVar(&cfg.Warmup, "warmup", cfg.Warmup, "time to wait before injecting failures")
+	flagSet.DurationVar(&cfg.Duration, "duration", cfg.Duration, "time to inject failures")
+	flagSet.DurationVar(&cfg.FailureInterval, "fail-every", cfg.FailureInterval, "stop the leader of a random group every interval, 0 disables failures")
+	flagSet.DurationVar(&cfg.RecoverAfter, "recover-after", cfg.RecoverAfter, "time before a failed member resumes heartbeats")
+	flagSet.DurationVar(&cfg.Grace, "grace", cfg.Grace, "max time to wait for pending failovers after the last injected failure")
+	flagSet.IntVar(&cfg.Shards, "shards", cfg.Shards, "number of goroutines writing heartbeats")
+	flagSet.Int64Var(&cfg.Seed, "seed", cfg.Seed, "random seed of failure injection")
+	asJSON := flagSet.Bool("json", false, "print the report as json")
+	verbose := flagSet.Bool("verbose", false, "keep hasky logs")
+	flagSet.Parse(args)
+
+	//压测时只保留错误日志
+	if !*verbose {
+		logger.Default().SetLevel(logger.ERROR)
+	}
+
+	fmt.Fprintf(os.Stderr, "bench: %d groups x %d members, warmup %s, duration %s\n",
+		cfg.Groups, cfg.Members, cfg.Warmup, cfg.Duration)
+	rep, err := Run(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+	if *asJSON {
+		rep.PrintJSON(os.Stdout)
+	} else {
+		rep.Print(os.Stdout)
+	}
+	return 0
+}
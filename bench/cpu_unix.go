@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package bench
+
+import (
+	"syscall"
+	"time"
+)
+
+//进程已使用的CPU时间(用户态+内核态)
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
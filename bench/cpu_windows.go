@@ -0,0 +1,10 @@
+package bench
+
+import (
+	"time"
+)
+
+//windows下不统计CPU时间
+func cpuTime() time.Duration {
+	return 0
+}
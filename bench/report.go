@@ -0,0 +1,103 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/olekukonko/tablewriter"
+	"golang.org/x/net/context"
+	"io"
+	"runtime"
+	"time"
+)
+
+//压测报告
+type Report struct {
+	Groups            int     `json:"groups"`
+	Members           int     `json:"members"`
+	HeartbeatInterval string  `json:"heartbeat_interval"`
+	HeartbeatTtl      string  `json:"heartbeat_ttl"`
+	Elapsed           string  `json:"elapsed"`
+	FailuresInjected  int     `json:"failures_injected"`
+	Failovers         int     `json:"failovers"`
+	FailoversMissed   int     `json:"failovers_missed"`
+	Recovered         int     `json:"recovered"`
+	LatencyP50        string  `json:"failover_latency_p50"`
+	LatencyP90        string  `json:"failover_latency_p90"`
+	LatencyP99        string  `json:"failover_latency_p99"`
+	LatencyMax        string  `json:"failover_latency_max"`
+	CPUSeconds        float64 `json:"cpu_seconds"`
+	CPUPercent        float64 `json:"cpu_percent"`
+	GoroutinesMax     int     `json:"goroutines_max"`
+	GoroutinesEnd     int     `json:"goroutines_end"`
+	HeapMaxMB         float64 `json:"heap_max_mb"`
+	BackendOps        uint64  `json:"backend_ops"`
+	BackendOpsPerSec  float64 `json:"backend_ops_per_sec"`
+	Checks            int64   `json:"checks"`
+	Resyncs           int64   `json:"resyncs"`
+}
+
+//以表格形式输出报告
+func (rep *Report) Print(w io.Writer) {
+	table := tablewriter.NewWriter(w)
+	table.SetHeader([]string{"item", "value"})
+	table.AppendBulk([][]string{
+		{"groups x members", fmt.Sprintf("%d x %d", rep.Groups, rep.Members)},
+		{"heartbeat interval / ttl", rep.HeartbeatInterval + " / " + rep.HeartbeatTtl},
+		{"elapsed", rep.Elapsed},
+		{"failures injected", fmt.Sprint(rep.FailuresInjected)},
+		{"failovers observed", fmt.Sprint(rep.Failovers)},
+		{"failovers missed", fmt.Sprint(rep.FailoversMissed)},
+		{"members recovered", fmt.Sprint(rep.Recovered)},
+		{"failover latency p50", rep.LatencyP50},
+		{"failover latency p90", rep.LatencyP90},
+		{"failover latency p99", rep.LatencyP99},
+		{"failover latency max", rep.LatencyMax},
+		{"cpu", fmt.Sprintf("%.2fs (%.1f%%)", rep.CPUSeconds, rep.CPUPercent)},
+		{"hasky goroutines max / end", fmt.Sprintf("%d / %d", rep.GoroutinesMax, rep.GoroutinesEnd)},
+		{"heap max", fmt.Sprintf("%.1f MB", rep.HeapMaxMB)},
+		{"backend ops (hasky)", fmt.Sprintf("%d (%.1f/s)", rep.BackendOps, rep.BackendOpsPerSec)},
+		{"checks", fmt.Sprint(rep.Checks)},
+		{"watch resyncs", fmt.Sprint(rep.Resyncs)},
+	})
+	table.Render()
+}
+
+//以json形式输出报告
+func (rep *Report) PrintJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rep)
+}
+
+//定期采样协程数与堆内存
+type sampler struct {
+	maxGoroutines  int
+	lastGoroutines int
+	maxHeap        uint64
+}
+
+func newSampler() *sampler {
+	return &sampler{}
+}
+
+//采样结果在ctx结束后才可读取
+func (s *sampler) run(ctx context.Context, base int) {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	var mem runtime.MemStats
+	for {
+		s.lastGoroutines = runtime.NumGoroutine() - base
+		if s.lastGoroutines > s.maxGoroutines {
+			s.maxGoroutines = s.lastGoroutines
+		}
+		runtime.ReadMemStats(&mem)
+		if mem.HeapAlloc > s.maxHeap {
+			s.maxHeap = mem.HeapAlloc
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
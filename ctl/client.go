@@ -0,0 +1,129 @@
+package ctl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//访问hasky HTTP API的客户端
+type Client struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+//创建客户端, addr没有scheme时配置了证书则使用https, 否则使用http
+func NewClient(addr, token string, tlsConfig *tls.Config, timeout time.Duration) *Client {
+	if !strings.Contains(addr, "://") {
+		if tlsConfig != nil {
+			addr = "https://" + addr
+		} else {
+			addr = "http://" + addr
+		}
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}
+	return &Client{
+		addr:  strings.TrimSuffix(addr, "/"),
+		token: token,
+		http:  &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+//客户端证书与CA, 都为空时返回nil
+func newTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("-cert and -key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+//发起请求, body不为空时作为请求体发送; 响应为json时解析到out, out为*string时保存原始响应
+//非200的响应返回错误, 错误信息取自响应中的message
+func (c *Client) do(method, path string, params url.Values, body []byte, out interface{}) error {
+	u := c.addr + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(data))
+		}
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, e.Message)
+	}
+	if s, ok := out.(*string); ok {
+		*s = string(data)
+		return nil
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func (c *Client) get(path string, params url.Values, out interface{}) error {
+	return c.do("GET", path, params, nil, out)
+}
+
+func (c *Client) post(path string, params url.Values, out interface{}) error {
+	return c.do("POST", path, params, nil, out)
+}
+
+//以json请求体发送POST请求
+func (c *Client) postBody(path string, params url.Values, body []byte, out interface{}) error {
+	return c.do("POST", path, params, body, out)
+}
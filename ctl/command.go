@@ -0,0 +1,450 @@
+package ctl
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/snapshot"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//ctl子命令, 子命令的参数需放在位置参数之前
+type command struct {
+	name string
+	args string
+	help string
+	run  func(c *ctl, args []string) error
+}
+
+//子命令的运行环境
+type ctl struct {
+	client *Client
+	printer
+}
+
+var commands = []*command{
+	{name: "groups", help: "list groups with leader and member health", run: groupsCommand},
+	{name: "members", args: "[-group g] [-zone z] [-tag t] [-health healthy|unhealthy] [-state s]", help: "list members", run: membersCommand},
+	{name: "leader", args: "<group>", help: "show the leader of a group and its health", run: leaderCommand},
+	{name: "promote", args: "[-force] <group> <member>", help: "make a member the leader", run: promoteCommand},
+	{name: "switch", args: "<group>", help: "switch the leader by the failover rules", run: switchCommand},
+	{name: "enable", args: "<group> <member>", help: "clear the maintenance state of a member", run: adminStateCommand("enable")},
+	{name: "disable", args: "<group> <member>", help: "exclude a member from elections", run: adminStateCommand("disable")},
+	{name: "drain", args: "<group> <member>", help: "put a member into maintenance, hand over leadership first", run: adminStateCommand("drain")},
+	{name: "events", args: "[-group g] [-limit n] [-f] [-interval d]", help: "show recent events, -f keeps tailing", run: eventsCommand},
+	{name: "history", args: "<group> [member]", help: "show member state transitions", run: historyCommand},
+	{name: "export", args: "[-o file] [-heartbeats] [-include-secrets]", help: "export a snapshot of all hasky keys, API tokens only with -include-secrets", run: exportCommand},
+	{name: "import", args: "[-conflict skip|overwrite|fail] [-dry-run] <file|->", help: "import a snapshot, requires an admin token", run: importCommand},
+}
+
+//hasky ctl 子命令, 返回进程退出码
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("hasky ctl", flag.ExitOnError)
+	addr := flagSet.String("addr", envOr("HASKY_ADDR", "http://127.0.0.1:16630"), "hasky HTTP API address, $HASKY_ADDR")
+	token := flagSet.String("token", os.Getenv("HASKY_TOKEN"), "API token, $HASKY_TOKEN")
+	caFile := flagSet.String("cacert", "", "CA bundle to verify the hasky https certificate")
+	certFile := flagSet.String("cert", "", "client certificate for mTLS")
+	keyFile := flagSet.String("key", "", "client key for mTLS")
+	timeout := flagSet.Duration("timeout", 10*time.Second, "timeout of each request")
+	asJSON := flagSet.Bool("json", false, "print results as json")
+	flagSet.Usage = func() { usage(flagSet) }
+	flagSet.Parse(args)
+
+	if flagSet.NArg() == 0 {
+		usage(flagSet)
+		return 2
+	}
+	name := flagSet.Arg(0)
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "hasky ctl: unknown command %q\n", name)
+		usage(flagSet)
+		return 2
+	}
+	tlsConfig, err := newTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hasky ctl: %v\n", err)
+		return 1
+	}
+	c := &ctl{
+		client:  NewClient(*addr, *token, tlsConfig, *timeout),
+		printer: printer{out: os.Stdout, json: *asJSON},
+	}
+	if err := cmd.run(c, flagSet.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "hasky ctl %s: %v\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+func usage(flagSet *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "usage: hasky ctl [options] <command> [args]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n           %s\n", cmd.name, cmd.args, cmd.help)
+	}
+	fmt.Fprintf(os.Stderr, "\noptions:\n")
+	flagSet.PrintDefaults()
+}
+
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func envOr(key, value string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return value
+}
+
+//检查位置参数的个数
+func checkArgs(args []string, min, max int, usage string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func groupsCommand(c *ctl, args []string) error {
+	if err := checkArgs(args, 0, 0, "groups"); err != nil {
+		return err
+	}
+	var groups []*etcd.GroupSummary
+	if err := c.client.get("/groups", nil, &groups); err != nil {
+		return err
+	}
+	rows := make([][]string, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, []string{g.Group, orDash(g.Leader), orDash(string(g.LeaderState)),
+			fmt.Sprintf("%d/%d", g.Healthy, g.Members), orDash(strings.Join(g.MissingMembers, ",")), orDash(g.LastProbeError)})
+	}
+	return c.print(groups, []string{"group", "leader", "leader state", "healthy", "missing", "last probe error"}, rows)
+}
+
+func membersCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("members", flag.ContinueOnError)
+	group := fs.String("group", "", "group name")
+	zone := fs.String("zone", "", "zone of members")
+	var tags stringList
+	fs.Var(&tags, "tag", "tag of members, repeatable")
+	health := fs.String("health", "", "healthy or unhealthy")
+	state := fs.String("state", "", "member state")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkArgs(fs.Args(), 0, 0, "members [-group g] [-zone z] [-tag t] [-health h] [-state s]"); err != nil {
+		return err
+	}
+	params := url.Values{}
+	setParam(params, "group", *group)
+	setParam(params, "zone", *zone)
+	setParam(params, "health", *health)
+	setParam(params, "state", *state)
+	for _, tag := range tags {
+		params.Add("tag", tag)
+	}
+	var members []*etcd.MemberInfo
+	if err := c.client.get("/members", params, &members); err != nil {
+		return err
+	}
+	return c.printMembers(members)
+}
+
+func (c *ctl) printMembers(members []*etcd.MemberInfo) error {
+	rows := make([][]string, 0, len(members))
+	for _, m := range members {
+		zone, address := "-", "-"
+		if m.Meta != nil {
+			zone = orDash(m.Meta.Zone)
+			if m.Meta.Address != "" {
+				address = m.Meta.Address + ":" + strconv.Itoa(m.Meta.Port)
+			}
+		}
+		leader := ""
+		if m.Leader {
+			leader = "*"
+		}
+		rows = append(rows, []string{m.Group, m.Name, leader, orDash(string(m.State)), strconv.FormatBool(m.Healthy),
+			zone, address, age(m.LastHeartbeat)})
+	}
+	return c.print(members, []string{"group", "member", "leader", "state", "healthy", "zone", "address", "heartbeat age"}, rows)
+}
+
+func leaderCommand(c *ctl, args []string) error {
+	if err := checkArgs(args, 1, 1, "leader <group>"); err != nil {
+		return err
+	}
+	var members []*etcd.MemberInfo
+	if err := c.client.get("/members", url.Values{"group": {args[0]}}, &members); err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Leader {
+			return c.print(m, []string{"item", "value"}, [][]string{
+				{"group", m.Group},
+				{"leader", m.Name},
+				{"state", orDash(string(m.State))},
+				{"state since", formatTime(m.StateSince)},
+				{"state reason", orDash(m.StateReason)},
+				{"healthy", strconv.FormatBool(m.Healthy)},
+				{"heartbeat age", age(m.LastHeartbeat)},
+			})
+		}
+	}
+	return fmt.Errorf("group %s has no leader", args[0])
+}
+
+func promoteCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ContinueOnError)
+	force := fs.Bool("force", false, "skip the member state check")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkArgs(fs.Args(), 2, 2, "promote [-force] <group> <member>"); err != nil {
+		return err
+	}
+	params := url.Values{"group": {fs.Arg(0)}, "member": {fs.Arg(1)}}
+	if *force {
+		params.Set("force", "true")
+	}
+	if err := c.client.post("/leader/promote", params, nil); err != nil {
+		return err
+	}
+	return c.result(map[string]string{"group": fs.Arg(0), "leader": fs.Arg(1)},
+		fmt.Sprintf("promote of %s in %s requested", fs.Arg(1), fs.Arg(0)))
+}
+
+func switchCommand(c *ctl, args []string) error {
+	if err := checkArgs(args, 1, 1, "switch <group>"); err != nil {
+		return err
+	}
+	var leader string
+	if err := c.client.post("/leader/switch", url.Values{"group": {args[0]}}, &leader); err != nil {
+		return err
+	}
+	return c.result(map[string]string{"group": args[0], "leader": leader},
+		fmt.Sprintf("switch of %s to %s requested", args[0], leader))
+}
+
+//设置成员的维护状态, action为 enable/disable/drain
+func adminStateCommand(action string) func(c *ctl, args []string) error {
+	return func(c *ctl, args []string) error {
+		if err := checkArgs(args, 2, 2, action+" <group> <member>"); err != nil {
+			return err
+		}
+		if err := c.client.post("/member/"+action, url.Values{"group": {args[0]}, "member": {args[1]}}, nil); err != nil {
+			return err
+		}
+		return c.result(map[string]string{"group": args[0], "member": args[1], "action": action},
+			fmt.Sprintf("%s %s in %s: OK", action, args[1], args[0]))
+	}
+}
+
+func eventsCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	group := fs.String("group", "", "only events of this group")
+	limit := fs.Int("limit", 20, "number of recent events, 0 for all")
+	follow := fs.Bool("f", false, "keep printing new events")
+	interval := fs.Duration("interval", time.Second, "poll interval with -f")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkArgs(fs.Args(), 0, 0, "events [-group g] [-limit n] [-f] [-interval d]"); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+	params := url.Values{}
+	setParam(params, "group", *group)
+	if *limit > 0 {
+		params.Set("limit", strconv.Itoa(*limit))
+	}
+	var events []*etcd.Event
+	if err := c.client.get("/events", params, &events); err != nil {
+		return err
+	}
+	if !*follow {
+		rows := make([][]string, 0, len(events))
+		for _, e := range events {
+			rows = append(rows, []string{formatTime(e.Time), e.Type, orDash(e.Group), orDash(e.Member), e.Message})
+		}
+		return c.print(events, []string{"time", "type", "group", "member", "message"}, rows)
+	}
+
+	//持续输出新的事件, 每行一个, 直到被中断
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+	params.Del("limit")
+	var since uint64
+	for {
+		for _, e := range events {
+			c.printEvent(e)
+			since = e.Seq
+		}
+		select {
+		case <-interrupt:
+			return nil
+		case <-time.After(*interval):
+		}
+		params.Set("since", strconv.FormatUint(since, 10))
+		events = nil
+		if err := c.client.get("/events", params, &events); err != nil {
+			fmt.Fprintf(os.Stderr, "hasky ctl events: %v\n", err)
+		}
+	}
+}
+
+func (c *ctl) printEvent(e *etcd.Event) {
+	if c.json {
+		c.print(e, nil, nil)
+		return
+	}
+	fmt.Fprintf(c.out, "%s  %-14s %-24s %-12s %s\n", formatTime(e.Time), e.Type, orDash(e.Group), orDash(e.Member), e.Message)
+}
+
+func historyCommand(c *ctl, args []string) error {
+	if err := checkArgs(args, 1, 2, "history <group> [member]"); err != nil {
+		return err
+	}
+	params := url.Values{"group": {args[0]}}
+	var states []*etcd.MemberStatus
+	if len(args) == 2 {
+		params.Set("member", args[1])
+		var status etcd.MemberStatus
+		if err := c.client.get("/member/state", params, &status); err != nil {
+			return err
+		}
+		states = append(states, &status)
+	} else if err := c.client.get("/member/state", params, &states); err != nil {
+		return err
+	}
+	rows := make([][]string, 0)
+	for _, status := range states {
+		for _, t := range status.History {
+			rows = append(rows, []string{formatTime(t.Time), status.Name, string(t.From), string(t.To), t.Reason})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i][0] < rows[j][0] })
+	return c.print(states, []string{"time", "member", "from", "to", "reason"}, rows)
+}
+
+//导出快照, 始终输出json
+func exportCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("o", "-", "output file, - for stdout")
+	heartbeats := fs.Bool("heartbeats", false, "include member heartbeats")
+	secrets := fs.Bool("include-secrets", false, "include keys holding API tokens, anyone with the file can use them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkArgs(fs.Args(), 0, 0, "export [-o file] [-heartbeats] [-include-secrets]"); err != nil {
+		return err
+	}
+	params := url.Values{}
+	if *heartbeats {
+		params.Set("heartbeats", "true")
+	}
+	if *secrets {
+		params.Set("include_secrets", "true")
+	}
+	var snap etcd.Snapshot
+	if err := c.client.get("/snapshot", params, &snap); err != nil {
+		return err
+	}
+	if len(snap.Excluded) > 0 {
+		fmt.Fprintf(os.Stderr, "left out %d keys holding API tokens, use -include-secrets to export them\n", len(snap.Excluded))
+	}
+	if *output == "-" {
+		p := &printer{out: c.out, json: true}
+		return p.print(&snap, nil, nil)
+	}
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	p := &printer{out: f, json: true}
+	if err := p.print(&snap, nil, nil); err != nil {
+		f.Close()
+		return err
+	}
+	//写入的错误可能在关闭时才返回, 例如磁盘已满
+	return f.Close()
+}
+
+func importCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	conflict := fs.String("conflict", string(etcd.CONFLICT_SKIP), "skip, overwrite or fail on existing keys with different values")
+	dryRun := fs.Bool("dry-run", false, "print what would change without writing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkArgs(fs.Args(), 1, 1, "import [-conflict c] [-dry-run] <file|->"); err != nil {
+		return err
+	}
+	var data []byte
+	var err error
+	if fs.Arg(0) == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	params := url.Values{"conflict": {*conflict}}
+	if *dryRun {
+		params.Set("dry_run", "true")
+	}
+	var result etcd.ImportResult
+	if err := c.client.postBody("/snapshot", params, data, &result); err != nil {
+		return err
+	}
+	if c.json {
+		return c.print(&result, nil, nil)
+	}
+	snapshot.PrintResult(c.out, &result)
+	return nil
+}
+
+//操作的结果, json模式下输出v, 否则输出一行说明
+func (c *ctl) result(v interface{}, message string) error {
+	if c.json {
+		return c.print(v, nil, nil)
+	}
+	_, err := fmt.Fprintln(c.out, message)
+	return err
+}
+
+func setParam(params url.Values, key, value string) {
+	if value != "" {
+		params.Set(key, value)
+	}
+}
+
+//可以重复指定的参数
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,50 @@
+package ctl
+
+import (
+	"encoding/json"
+	"github.com/olekukonko/tablewriter"
+	"io"
+	"time"
+)
+
+//以表格或json输出结果
+type printer struct {
+	out  io.Writer
+	json bool
+}
+
+//json模式下输出v, 否则输出表格
+func (p *printer) print(v interface{}, header []string, rows [][]string) error {
+	if p.json {
+		enc := json.NewEncoder(p.out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	table := tablewriter.NewWriter(p.out)
+	table.SetHeader(header)
+	table.AppendBulk(rows)
+	table.Render()
+	return nil
+}
+
+//距今的时间, 为零值时返回"-"
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Truncate(time.Second).String()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
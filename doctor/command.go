@@ -0,0 +1,128 @@
+package doctor
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"github.com/olekukonko/tablewriter"
+	"io"
+	"os"
+	"time"
+)
+
+//doctor的json输出
+type report struct {
+	Problems []*Problem `json:"problems"`
+	Applied  []*Fix     `json:"applied,omitempty"`
+	Failed   []string   `json:"failed,omitempty"`
+	DryRun   bool       `json:"dry_run,omitempty"`
+}
+
+//hasky doctor 子命令, 直接连接etcd检查组的结构, 返回进程退出码:
+//0 没有问题或者问题都已修复, 1 仍有问题, 2 无法完成检查
+func Main(args []string) int {
+	flagSet := flag.NewFlagSet("hasky doctor", flag.ExitOnError)
+	etcdFlags := etcd.NewClientFlags(flagSet)
+	groupsDir := flagSet.String("groups-dir", "", "directory of group definitions, declared groups without members are not orphans")
+	stale := flagSet.Duration("stale", 24*time.Hour, "report members whose heartbeat is older than this, 0 disables the check")
+	fix := flagSet.Bool("fix", false, "apply the suggested fixes")
+	dryRun := flagSet.Bool("dry-run", false, "with -fix, print the changes without writing them")
+	verbose := flagSet.Bool("verbose", false, "keep hasky logs")
+	asJSON := flagSet.Bool("json", false, "print the report as json")
+	flagSet.Parse(args)
+
+	if !*verbose {
+		logger.Default().SetLevel(logger.ERROR)
+	}
+	namespaces, err := etcdFlags.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+		return 2
+	}
+	opts := &Options{Namespaces: namespaces, StaleAfter: *stale, Now: time.Now(), Declared: make(map[string]bool)}
+	if *groupsDir != "" {
+		defs, err := etcd.LoadGroupDefinitions(*groupsDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "doctor: %v\n", err)
+			return 2
+		}
+		for _, def := range defs {
+			opts.Declared[namespaces.GroupPath(def.Name)] = true
+		}
+	}
+	return Run(etcd.GetClient(), opts, *fix, *dryRun, *asJSON, os.Stdout)
+}
+
+//检查并按需修复, 输出报告, 返回进程退出码
+func Run(backend etcd.Backend, opts *Options, fix, dryRun, asJSON bool, out io.Writer) int {
+	problems, err := Inspect(backend, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "doctor: inspect %s failed: %v\n", opts.Namespaces.Prefix(), err)
+		return 2
+	}
+	rep := &report{Problems: problems, DryRun: fix && dryRun}
+	remaining := 0
+	for _, p := range problems {
+		if !fix || p.Fix == nil {
+			remaining++
+			continue
+		}
+		if dryRun {
+			rep.Applied = append(rep.Applied, p.Fix)
+			continue
+		}
+		if err := Apply(backend, p.Fix); err != nil {
+			rep.Failed = append(rep.Failed, fmt.Sprintf("%s: %v", p.Fix, err))
+			remaining++
+			continue
+		}
+		rep.Applied = append(rep.Applied, p.Fix)
+	}
+	if dryRun {
+		remaining = len(problems)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		enc.Encode(rep)
+	} else {
+		rep.print(out)
+	}
+	if remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (rep *report) print(out io.Writer) {
+	if len(rep.Problems) == 0 {
+		fmt.Fprintln(out, "no problems found")
+		return
+	}
+	table := tablewriter.NewWriter(out)
+	table.SetHeader([]string{"severity", "key", "problem", "fix"})
+	table.SetAutoWrapText(false)
+	for _, p := range rep.Problems {
+		fix := "-"
+		if p.Fix != nil {
+			fix = p.Fix.String()
+		}
+		table.Append([]string{string(p.Severity), p.Key, p.Message, fix})
+	}
+	table.Render()
+
+	verb := "applied"
+	if rep.DryRun {
+		verb = "would apply"
+	}
+	for _, f := range rep.Applied {
+		fmt.Fprintf(out, "%s: %s\n", verb, f)
+	}
+	for _, f := range rep.Failed {
+		fmt.Fprintf(out, "failed: %s\n", f)
+	}
+	fmt.Fprintf(out, "%d problems found, %d fixes %s\n", len(rep.Problems), len(rep.Applied), verb)
+}
@@ -0,0 +1,274 @@
+package doctor
+
+import (
+	"fmt"
+	"github.com/coreos/etcd/client"
+	"github.com/domac/hasky/etcd"
+	"sort"
+	"strings"
+	"time"
+)
+
+//问题的严重程度
+type Severity string
+
+const (
+	SEVERITY_ERROR   Severity = "error"   //hasky无法正常工作, 例如leader指向不存在的成员
+	SEVERITY_WARNING Severity = "warning" //可能是遗留数据, 不影响切换
+)
+
+//修复操作
+type FixAction string
+
+const (
+	FIX_SET        FixAction = "set"
+	FIX_DELETE     FixAction = "delete"
+	FIX_DELETE_DIR FixAction = "delete-dir"
+)
+
+//一次修复, 对一个key执行set或者删除
+type Fix struct {
+	Action FixAction `json:"action"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value,omitempty"`
+}
+
+func (f *Fix) String() string {
+	if f.Action == FIX_SET {
+		return fmt.Sprintf("set %s = %s", f.Key, f.Value)
+	}
+	return fmt.Sprintf("%s %s", f.Action, f.Key)
+}
+
+//检查出的问题, Fix为空时需要人工处理
+type Problem struct {
+	Severity Severity `json:"severity"`
+	Key      string   `json:"key"`
+	Message  string   `json:"message"`
+	Fix      *Fix     `json:"fix,omitempty"`
+}
+
+//检查参数
+type Options struct {
+	Namespaces *etcd.Namespaces
+	StaleAfter time.Duration //心跳超过该时间未更新的非leader成员视为遗留数据, 为0时不检查
+	Now        time.Time
+	Declared   map[string]bool //声明的组的完整路径, 没有成员时不视为遗留数据
+}
+
+//检查所有命名空间下组的结构:
+//<namespace>/<group>/leader             当前leader, 必须是组内的成员
+//<namespace>/<group>/policy             可选, 组策略json
+//<namespace>/<group>/members/<member>/  heartbeat 必须存在且可以解析, meta 可选json, state 可选 disabled/draining
+func Inspect(backend etcd.Backend, opts *Options) ([]*Problem, error) {
+	problems := make([]*Problem, 0)
+	for _, dir := range opts.Namespaces.Dirs() {
+		root, err := backend.GetTree(dir)
+		if err != nil {
+			if client.IsKeyNotFound(err) {
+				problems = append(problems, &Problem{SEVERITY_WARNING, dir, "namespace directory does not exist", nil})
+				continue
+			}
+			return nil, err
+		}
+		sortNodes(root)
+		for _, node := range root.Nodes {
+			if !node.Dir {
+				problems = append(problems, &Problem{SEVERITY_WARNING, node.Key, "unexpected key in namespace, groups must be directories", nil})
+				continue
+			}
+			problems = append(problems, inspectGroup(node, opts)...)
+		}
+	}
+	for _, path := range sortedKeys(opts.Declared) {
+		if !backend.IsDirExist(path + "/members") {
+			problems = append(problems, &Problem{SEVERITY_WARNING, path, "declared group does not exist, hasky creates it on start", nil})
+		}
+	}
+	return problems, nil
+}
+
+//成员的检查结果, 用于为组挑选新的leader
+type memberCheck struct {
+	name      string
+	dir       string
+	heartbeat time.Time
+	valid     bool //心跳可以解析且没有被清理
+	admin     bool //处于 disabled/draining
+}
+
+func inspectGroup(group *client.Node, opts *Options) []*Problem {
+	problems := make([]*Problem, 0)
+	var leaderNode, membersNode *client.Node
+	for _, node := range group.Nodes {
+		switch node.Key {
+		case group.Key + "/leader":
+			leaderNode = node
+		case group.Key + "/members":
+			membersNode = node
+		case group.Key + "/policy":
+			if node.Dir {
+				problems = append(problems, &Problem{SEVERITY_ERROR, node.Key, "policy must be a key, not a directory", nil})
+			} else if _, err := etcd.ParseGroupPolicy(node.Value); err != nil {
+				problems = append(problems, &Problem{SEVERITY_ERROR, node.Key, fmt.Sprintf("invalid group policy: %v", err), nil})
+			}
+		default:
+			problems = append(problems, &Problem{SEVERITY_WARNING, node.Key, "unexpected key in group", nil})
+		}
+	}
+
+	if membersNode == nil || !membersNode.Dir || len(membersNode.Nodes) == 0 {
+		if opts.Declared[group.Key] {
+			return problems
+		}
+		problems = append(problems, &Problem{SEVERITY_WARNING, group.Key, "orphaned group without members",
+			&Fix{Action: FIX_DELETE_DIR, Key: group.Key}})
+		return problems
+	}
+
+	members := make([]*memberCheck, 0, len(membersNode.Nodes))
+	for _, node := range membersNode.Nodes {
+		if !node.Dir {
+			problems = append(problems, &Problem{SEVERITY_WARNING, node.Key, "unexpected key in members, members must be directories", nil})
+			continue
+		}
+		m, found := inspectMember(node, opts)
+		problems = append(problems, found...)
+		if m != nil {
+			members = append(members, m)
+		}
+	}
+
+	leader := ""
+	if leaderNode != nil {
+		if leaderNode.Dir {
+			problems = append(problems, &Problem{SEVERITY_ERROR, leaderNode.Key, "leader must be a key, not a directory", nil})
+			return problems
+		}
+		leader = leaderNode.Value
+	}
+	leaderKey := group.Key + "/leader"
+	var current *memberCheck
+	for _, m := range members {
+		if m.name == leader {
+			current = m
+		}
+	}
+	switch {
+	case leader == "":
+		problems = append(problems, &Problem{SEVERITY_ERROR, leaderKey, "group has members but no leader", leaderFix(leaderKey, leader, members)})
+	case current == nil:
+		problems = append(problems, &Problem{SEVERITY_ERROR, leaderKey, fmt.Sprintf("leader points at missing member %q", leader), leaderFix(leaderKey, leader, members)})
+	case !current.valid:
+		problems = append(problems, &Problem{SEVERITY_ERROR, leaderKey, fmt.Sprintf("leader %q has no valid heartbeat", leader), leaderFix(leaderKey, leader, members)})
+	case current.admin:
+		problems = append(problems, &Problem{SEVERITY_WARNING, leaderKey, fmt.Sprintf("leader %q is disabled or draining", leader), leaderFix(leaderKey, leader, members)})
+	}
+	return problems
+}
+
+//检查成员目录, 返回成员的检查结果与发现的问题; 整个成员目录将被清理时返回nil
+func inspectMember(node *client.Node, opts *Options) (*memberCheck, []*Problem) {
+	problems := make([]*Problem, 0)
+	m := &memberCheck{name: node.Key[strings.LastIndex(node.Key, "/")+1:], dir: node.Key}
+	if len(node.Nodes) == 0 {
+		problems = append(problems, &Problem{SEVERITY_WARNING, node.Key, "empty member directory",
+			&Fix{Action: FIX_DELETE_DIR, Key: node.Key}})
+		return nil, problems
+	}
+	hasHeartbeat := false
+	for _, file := range node.Nodes {
+		switch file.Key {
+		case node.Key + "/heartbeat":
+			hasHeartbeat = true
+			hb, err := etcd.ParseHeartbeat(file.Value)
+			if err != nil || file.Dir {
+				problems = append(problems, &Problem{SEVERITY_ERROR, file.Key, fmt.Sprintf("malformed heartbeat %q", file.Value),
+					&Fix{Action: FIX_DELETE, Key: file.Key}})
+				continue
+			}
+			m.heartbeat = hb
+			m.valid = true
+		case node.Key + "/meta":
+			if _, err := etcd.ParseMemberMeta(file.Value); err != nil || file.Dir {
+				problems = append(problems, &Problem{SEVERITY_WARNING, file.Key, fmt.Sprintf("malformed member meta: %v", err),
+					&Fix{Action: FIX_DELETE, Key: file.Key}})
+			}
+		case node.Key + "/state":
+			switch etcd.MemberState(file.Value) {
+			case etcd.STATE_DISABLED, etcd.STATE_DRAINING:
+				m.admin = true
+			default:
+				problems = append(problems, &Problem{SEVERITY_WARNING, file.Key, fmt.Sprintf("invalid admin state %q, must be disabled or draining", file.Value),
+					&Fix{Action: FIX_DELETE, Key: file.Key}})
+			}
+		default:
+			problems = append(problems, &Problem{SEVERITY_WARNING, file.Key, "unexpected key in member", nil})
+		}
+	}
+	if !hasHeartbeat {
+		problems = append(problems, &Problem{SEVERITY_WARNING, node.Key, "member has no heartbeat", nil})
+	}
+	if m.valid && opts.StaleAfter > 0 && opts.Now.Sub(m.heartbeat) > opts.StaleAfter {
+		problems = append(problems, &Problem{SEVERITY_WARNING, node.Key,
+			fmt.Sprintf("no heartbeat for %s", opts.Now.Sub(m.heartbeat).Truncate(time.Second)), nil})
+		m.valid = false
+	}
+	return m, problems
+}
+
+//leader的修复: 指向心跳最新的可用成员, 没有可用成员时删除leader由hasky重新选举
+func leaderFix(leaderKey, leader string, members []*memberCheck) *Fix {
+	var best *memberCheck
+	for _, m := range members {
+		if !m.valid || m.admin || m.name == leader {
+			continue
+		}
+		if best == nil || m.heartbeat.After(best.heartbeat) {
+			best = m
+		}
+	}
+	if best != nil {
+		return &Fix{Action: FIX_SET, Key: leaderKey, Value: best.name}
+	}
+	if leader == "" {
+		return nil
+	}
+	return &Fix{Action: FIX_DELETE, Key: leaderKey}
+}
+
+//执行修复, 返回第一个错误; 已经不存在的key视为修复成功
+func Apply(backend etcd.Backend, fix *Fix) error {
+	var err error
+	switch fix.Action {
+	case FIX_SET:
+		err = backend.Set(fix.Key, fix.Value)
+	case FIX_DELETE:
+		err = backend.Delete(fix.Key)
+	case FIX_DELETE_DIR:
+		err = backend.DeleteDir(fix.Key)
+	default:
+		return fmt.Errorf("unknown fix action %q", fix.Action)
+	}
+	if err != nil && client.IsKeyNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//按key排序, 输出的顺序固定
+func sortNodes(node *client.Node) {
+	sort.Slice(node.Nodes, func(i, j int) bool { return node.Nodes[i].Key < node.Nodes[j].Key })
+	for _, child := range node.Nodes {
+		sortNodes(child)
+	}
+}
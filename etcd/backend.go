@@ -0,0 +1,32 @@
+package etcd
+
+import (
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"time"
+)
+
+//注册中心的存储后端, 默认由etcd客户端实现
+type Backend interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	SetTtl(key string, value string, ttl time.Duration) error
+	Delete(key string) error
+	DeleteDir(dir string) error
+	CreateDir(dir string) error
+	IsDirExist(dir string) bool
+	IsFileExist(file string) bool
+	GetTree(key string) (*client.Node, error)
+	GetDirChildren(key string) ([]string, error)
+	GetFileChildren(key string) ([]string, error)
+	CreateWatcher(dir string) (client.Watcher, error)
+	CreateDirWatcher(dir string) (client.Watcher, error)
+	AutoSync(ctx context.Context, interval time.Duration) error
+}
+
+//释放不再使用的watcher, etcd的watcher没有需要释放的资源
+func closeWatcher(w client.Watcher) {
+	if c, ok := w.(interface{ Close() }); ok {
+		c.Close()
+	}
+}
@@ -1,15 +1,24 @@
 package etcd
 
 import (
-	log "github.com/alecthomas/log4go"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/coreos/etcd/client"
+	"github.com/domac/hasky/logger"
 	"golang.org/x/net/context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
 	"time"
 )
 
 //Etcd客户端
 type Client struct {
 	client client.Client
+	log    *logger.Logger
 }
 
 var (
@@ -24,22 +33,140 @@ const (
 	Watch_Action_Delete string = "delete"
 )
 
-func Init(endpoints []string) error {
-	cfg := client.Config{
-		Endpoints:               endpoints,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second * 5,
+//etcd连接配置
+type ClientConfig struct {
+	Endpoints []string
+
+	//客户端证书与CA, 访问https的etcd时使用
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	//etcd开启认证时使用
+	Username string
+	Password string
+
+	//组所在的命名空间, 为nil时使用默认的命名空间
+	Namespaces *Namespaces
+
+	//请求与建立连接的超时, 为0时使用默认值
+	RequestTimeout time.Duration
+	DialTimeout    time.Duration
+
+	//日志器, 为nil时使用默认日志器
+	Logger *logger.Logger
+}
+
+//创建使用DialTimeout的transport, 配置了证书时同时设置tls
+func newTransport(cfg *ClientConfig) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		Dial: (&net.Dialer{
+			Timeout:   cfg.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}, nil
+}
+
+//根据证书配置创建tls配置, 没有配置证书时返回nil
+func newTLSConfig(cfg *ClientConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" && cfg.KeyFile == "" && cfg.CAFile == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("etcd client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load etcd client certificate failed: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read etcd CA bundle failed: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in etcd CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
+	return tlsConfig, nil
+}
 
-	var err error
-	cli.client, err = client.New(cfg)
+func Init(cfg *ClientConfig) error {
+	if cfg.Namespaces == nil {
+		cfg.Namespaces = DefaultNamespaces()
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = ETCD_REQUEST_TIMEOUT
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = ETCD_DIAL_TIMEOUT
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = logger.Default()
+	}
+	cli.log = cfg.Logger.Named("etcd")
+	transport, err := newTransport(cfg)
 	if err != nil {
-		log.Error("connect to etcd err: %v", err)
+		cli.log.Error("invalid etcd tls config", "error", err)
+		return err
+	}
+	clientCfg := client.Config{
+		Endpoints:               cfg.Endpoints,
+		Transport:               transport,
+		Username:                cfg.Username,
+		Password:                cfg.Password,
+		HeaderTimeoutPerRequest: cfg.RequestTimeout,
+	}
+
+	cli.client, err = client.New(clientCfg)
+	if err != nil {
+		cli.log.Error("create etcd client failed", "endpoints", strings.Join(cfg.Endpoints, ","), "error", err)
 		return err
 	}
-	log.Info(">>>>>> Etcd Client init <<<<<<")
-	log.Info("etcd connect success : %v", endpoints)
 	ctx = context.Background()
+	if err = verify(cfg); err != nil {
+		cli.log.Error("etcd handshake failed", "endpoints", strings.Join(cfg.Endpoints, ","), "error", err)
+		return err
+	}
+	cli.log.Info("etcd client initialized", "endpoints", strings.Join(cfg.Endpoints, ","))
+	return nil
+}
+
+//启动时访问一次etcd, 证书或者认证错误直接返回;
+//etcd暂时不可用时只记录日志, 由服务发现稍后重试
+func verify(cfg *ClientConfig) error {
+	c, cancel := context.WithTimeout(ctx, cfg.RequestTimeout)
+	defer cancel()
+	_, err := client.NewKeysAPI(cli.client).Get(c, cfg.Namespaces.Prefix(), nil)
+	if err == nil || client.IsKeyNotFound(err) {
+		return nil
+	}
+	if e, ok := err.(client.Error); ok && e.Code == client.ErrorCodeUnauthorized {
+		return fmt.Errorf("etcd authentication failed for user %q: %s", cfg.Username, e.Message)
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "x509:"):
+		return fmt.Errorf("etcd certificate verification failed, check etcd-cacert: %v", err)
+	case strings.Contains(msg, "tls:") || strings.Contains(msg, "HTTP response to HTTPS client"):
+		return fmt.Errorf("etcd tls handshake failed, check etcd-cert/etcd-key and endpoint scheme: %v", err)
+	case strings.Contains(msg, "malformed HTTP response"):
+		return fmt.Errorf("etcd endpoint %v expects https: %v", cfg.Endpoints, err)
+	}
+	cli.log.Warn("etcd is not reachable now, retry later", "error", err)
 	return nil
 }
 
@@ -134,6 +261,16 @@ func (ec *Client) GetDirChildren(key string) ([]string, error) {
 	return children, nil
 }
 
+//递归获取节点树
+func (ec *Client) GetTree(key string) (*client.Node, error) {
+	kapi := client.NewKeysAPI(ec.client)
+	resp, err := kapi.Get(ctx, key, &client.GetOptions{Recursive: true})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Node, nil
+}
+
 func (ec *Client) Delete(key string) (err error) {
 	kapi := client.NewKeysAPI(ec.client)
 	_, err = kapi.Delete(ctx, key, nil)
@@ -143,6 +280,18 @@ func (ec *Client) Delete(key string) (err error) {
 	return nil
 }
 
+//递归删除目录
+func (ec *Client) DeleteDir(dir string) error {
+	kapi := client.NewKeysAPI(ec.client)
+	_, err := kapi.Delete(ctx, dir, &client.DeleteOptions{Recursive: true, Dir: true})
+	return err
+}
+
+//同步集群节点列表, 直到ctx结束
+func (ec *Client) AutoSync(c context.Context, interval time.Duration) error {
+	return ec.client.AutoSync(c, interval)
+}
+
 //列出目录的所有value
 func (ec *Client) List(dir string) ([]string, error) {
 	var values []string
@@ -169,7 +318,7 @@ func (ec *Client) CreateWatcher(dir string) (client.Watcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Info("star watch %s after %d\n", dir, respGet.Index)
+	ec.log.Info("start watch", "dir", dir, "after", respGet.Index)
 	w := kapi.Watcher(dir, &client.WatcherOptions{AfterIndex: respGet.Index,
 		Recursive: true})
 	return w, err
@@ -181,7 +330,7 @@ func (ec *Client) CreateDirWatcher(dir string) (client.Watcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Info("star watch %s after %d\n", dir, respGet.Index)
+	ec.log.Info("start watch", "dir", dir, "index", respGet.Index)
 	w := kapi.Watcher(dir, &client.WatcherOptions{Recursive: true})
 	return w, err
 }
@@ -0,0 +1,33 @@
+package etcd
+
+import (
+	"github.com/coreos/etcd/client"
+	"net"
+	"testing"
+	"time"
+)
+
+//没有配置证书时也创建自己的transport, 使用 etcd-dial-timeout
+func TestTransportDialTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	transport, err := newTransport(&ClientConfig{DialTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.CancelableTransport(transport) == client.DefaultTransport || transport.Dial == nil {
+		t.Fatal("plain etcd uses the default transport")
+	}
+	if transport.TLSClientConfig != nil {
+		t.Fatal("tls configured without certificates")
+	}
+	conn, err := transport.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -9,9 +9,62 @@ type RegistryEvent byte
 type OperationEvent byte
 
 const (
-	DISCOVERY = "/hasky/agent-groups"
+	//etcd中的根路径与默认命名空间, 组默认位于 /hasky/agent-groups
+	DEFAULT_ETCD_PREFIX = "/hasky"
+	DEFAULT_NAMESPACE   = "agent-groups"
 
+	//etcd请求与建立连接的超时, 以及同步集群成员的间隔
+	ETCD_REQUEST_TIMEOUT = 5 * time.Second
+	ETCD_DIAL_TIMEOUT    = 30 * time.Second
+	AUTO_SYNC_INTERVAL   = 10 * time.Second
+
+	//agent写入心跳的间隔
+	HEARTBEAT_INTERVAL = time.Second
+
+	//配置了主动探测时, 探测leader的间隔
 	CHECK_ALIVE_INTERVAL = 2 * time.Second
+
+	//同时执行检查的worker数量
+	CHECK_CONCURRENCY = 16
+
+	//抖动检测的统计窗口, 成员窗口内从healthy变为不健康达到该次数时隔离
+	FLAP_WINDOW         = 60 * time.Second
+	FLAP_THRESHOLD      = 3
+	FLAP_QUARANTINE_MIN = 30 * time.Second
+	FLAP_QUARANTINE_MAX = 10 * time.Minute
+
+	//组在窗口内切换达到该次数时抑制切换
+	GROUP_FLAP_THRESHOLD = 3
+	GROUP_DAMPING        = 2 * time.Minute
+
+	//切换保护: 定期访问etcd, 连续失败或者超过一段时间没有成功访问时视为etcd不可达
+	GUARD_PING_INTERVAL   = 2 * time.Second
+	GUARD_CONTACT_TIMEOUT = 10 * time.Second
+	GUARD_MAX_FAILURES    = 3
+	GUARD_STALE_CACHE     = time.Second
+
+	//窗口内失效的成员超过该比例时拒绝切换, 成员总数较少时不做判断
+	FAILOVER_MAX_STALE_FRACTION = 0.5
+	MASS_STALE_WINDOW           = 30 * time.Second
+	MASS_STALE_MIN_MEMBERS      = 10
+
+	//时钟跳变超过该值时, 一段时间内拒绝切换
+	CLOCK_JUMP_TOLERANCE = time.Second
+	CLOCK_SUSPECT_PERIOD = 30 * time.Second
+
+	//调度器的默认协程数与排队上限
+	SCHEDULER_WORKERS     = 4
+	SCHEDULER_QUEUE_LIMIT = 4096
+
+	//定期校正etcd与内存状态的间隔
+	RECONCILE_INTERVAL = 30 * time.Second
+
+	//watch出错后的重试间隔
+	WATCH_RETRY_MIN = 200 * time.Millisecond
+	WATCH_RETRY_MAX = 10 * time.Second
+
+	//超过该时间未更新心跳的成员视为不健康
+	MEMBER_HEARTBEAT_TIMEOUT = 5 * time.Second
 )
 
 const (
@@ -24,3 +77,15 @@ const (
 	ExitEvent   OperationEvent = 2
 	StopEvent   OperationEvent = 3
 )
+
+func (e OperationEvent) String() string {
+	switch e {
+	case UpdateEvent:
+		return "update"
+	case ExitEvent:
+		return "exit"
+	case StopEvent:
+		return "stop"
+	}
+	return "unknown"
+}
@@ -0,0 +1,192 @@
+package etcd
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+//注册中心的可调参数, 默认值见 common.go, 在Start之前通过 SetConfig 设置
+//运行中可以通过 UpdateConfig 修改, 检查并发数与调度参数除外
+type Config struct {
+	//与etcd的同步
+	AutoSyncInterval  time.Duration
+	ReconcileInterval time.Duration
+	WatchRetryMin     time.Duration
+	WatchRetryMax     time.Duration
+
+	//成员检查: 心跳超过3个间隔未更新视为suspect, 超过10个间隔视为dead
+	HeartbeatInterval      time.Duration
+	MemberHeartbeatTimeout time.Duration
+	CheckInterval          time.Duration
+	CheckConcurrency       int
+
+	//组没有配置policy时使用的策略
+	DefaultPolicy *GroupPolicy
+	//策略来自etcd, 默认不执行其中的exec探针, 只能由本机的配置开启
+	ExecProbes bool
+
+	//抖动抑制
+	FlapWindow         time.Duration
+	FlapThreshold      int
+	FlapQuarantineMin  time.Duration
+	FlapQuarantineMax  time.Duration
+	GroupFlapThreshold int
+	GroupDamping       time.Duration
+
+	//切换保护
+	GuardPingInterval        time.Duration
+	GuardContactTimeout      time.Duration
+	GuardMaxFailures         int
+	FailoverMaxStaleFraction float64
+	MassStaleWindow          time.Duration
+	MassStaleMinMembers      int
+	ClockJumpTolerance       time.Duration
+	ClockSuspectPeriod       time.Duration
+
+	//调度
+	SchedulerWorkers    int
+	SchedulerQueueLimit int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		AutoSyncInterval:  AUTO_SYNC_INTERVAL,
+		ReconcileInterval: RECONCILE_INTERVAL,
+		WatchRetryMin:     WATCH_RETRY_MIN,
+		WatchRetryMax:     WATCH_RETRY_MAX,
+
+		HeartbeatInterval:      HEARTBEAT_INTERVAL,
+		MemberHeartbeatTimeout: MEMBER_HEARTBEAT_TIMEOUT,
+		CheckInterval:          CHECK_ALIVE_INTERVAL,
+		CheckConcurrency:       CHECK_CONCURRENCY,
+
+		DefaultPolicy: &GroupPolicy{},
+
+		FlapWindow:         FLAP_WINDOW,
+		FlapThreshold:      FLAP_THRESHOLD,
+		FlapQuarantineMin:  FLAP_QUARANTINE_MIN,
+		FlapQuarantineMax:  FLAP_QUARANTINE_MAX,
+		GroupFlapThreshold: GROUP_FLAP_THRESHOLD,
+		GroupDamping:       GROUP_DAMPING,
+
+		GuardPingInterval:        GUARD_PING_INTERVAL,
+		GuardContactTimeout:      GUARD_CONTACT_TIMEOUT,
+		GuardMaxFailures:         GUARD_MAX_FAILURES,
+		FailoverMaxStaleFraction: FAILOVER_MAX_STALE_FRACTION,
+		MassStaleWindow:          MASS_STALE_WINDOW,
+		MassStaleMinMembers:      MASS_STALE_MIN_MEMBERS,
+		ClockJumpTolerance:       CLOCK_JUMP_TOLERANCE,
+		ClockSuspectPeriod:       CLOCK_SUSPECT_PERIOD,
+
+		SchedulerWorkers:    SCHEDULER_WORKERS,
+		SchedulerQueueLimit: SCHEDULER_QUEUE_LIMIT,
+	}
+}
+
+//检查参数, 返回第一个不合法的参数
+func (c *Config) Validate() error {
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"etcd-auto-sync-interval", c.AutoSyncInterval},
+		{"reconcile-interval", c.ReconcileInterval},
+		{"watch-retry-min", c.WatchRetryMin},
+		{"watch-retry-max", c.WatchRetryMax},
+		{"heartbeat-interval", c.HeartbeatInterval},
+		{"member-heartbeat-timeout", c.MemberHeartbeatTimeout},
+		{"check-interval", c.CheckInterval},
+		{"flap-window", c.FlapWindow},
+		{"flap-quarantine-min", c.FlapQuarantineMin},
+		{"flap-quarantine-max", c.FlapQuarantineMax},
+		{"group-damping", c.GroupDamping},
+		{"guard-ping-interval", c.GuardPingInterval},
+		{"guard-contact-timeout", c.GuardContactTimeout},
+		{"mass-stale-window", c.MassStaleWindow},
+		{"clock-jump-tolerance", c.ClockJumpTolerance},
+		{"clock-suspect-period", c.ClockSuspectPeriod},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %s", d.name, d.value)
+		}
+	}
+	counts := []struct {
+		name  string
+		value int
+	}{
+		{"check-concurrency", c.CheckConcurrency},
+		{"flap-threshold", c.FlapThreshold},
+		{"group-flap-threshold", c.GroupFlapThreshold},
+		{"guard-max-failures", c.GuardMaxFailures},
+		{"mass-stale-min-members", c.MassStaleMinMembers},
+		{"scheduler-workers", c.SchedulerWorkers},
+		{"scheduler-queue-limit", c.SchedulerQueueLimit},
+	}
+	for _, n := range counts {
+		if n.value <= 0 {
+			return fmt.Errorf("%s must be positive, got %d", n.name, n.value)
+		}
+	}
+	switch {
+	case c.WatchRetryMin > c.WatchRetryMax:
+		return fmt.Errorf("watch-retry-min (%s) must not exceed watch-retry-max (%s)", c.WatchRetryMin, c.WatchRetryMax)
+	case c.FlapQuarantineMin > c.FlapQuarantineMax:
+		return fmt.Errorf("flap-quarantine-min (%s) must not exceed flap-quarantine-max (%s)", c.FlapQuarantineMin, c.FlapQuarantineMax)
+	case c.FailoverMaxStaleFraction <= 0 || c.FailoverMaxStaleFraction > 1:
+		return fmt.Errorf("failover-max-stale-fraction must be in (0, 1], got %g", c.FailoverMaxStaleFraction)
+	case c.GuardContactTimeout <= c.GuardPingInterval:
+		return fmt.Errorf("guard-contact-timeout (%s) must be longer than guard-ping-interval (%s)", c.GuardContactTimeout, c.GuardPingInterval)
+	case c.DefaultPolicy == nil:
+		return errors.New("default group policy must not be nil")
+	}
+	return nil
+}
+
+//设置注册中心的参数, 需在Start之前调用
+func (self *EtcdRegistry) SetConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	self.config.Store(cfg)
+	self.scheduler = newScheduler(cfg.SchedulerWorkers, cfg.SchedulerQueueLimit, self.metrics, self.handleExchange)
+	self.scheduler.log = self.logger.Named("scheduler")
+	return nil
+}
+
+//运行中替换参数, 检查并发数与调度参数在启动时确定, 修改时返回错误
+//心跳间隔立即应用到已有的worker, 默认策略或exec探针的开关变化时重新加载各组的策略
+func (self *EtcdRegistry) UpdateConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := self.Config()
+	switch {
+	case cfg.CheckConcurrency != old.CheckConcurrency:
+		return errors.New("check-concurrency cannot be changed without a restart")
+	case cfg.SchedulerWorkers != old.SchedulerWorkers:
+		return errors.New("scheduler-workers cannot be changed without a restart")
+	case cfg.SchedulerQueueLimit != old.SchedulerQueueLimit:
+		return errors.New("scheduler-queue-limit cannot be changed without a restart")
+	}
+	self.config.Store(cfg)
+
+	policyChanged := !reflect.DeepEqual(cfg.DefaultPolicy, old.DefaultPolicy) || cfg.ExecProbes != old.ExecProbes
+	for _, w := range self.workerList() {
+		w.lock.Lock()
+		w.KeepalivePeriod = cfg.HeartbeatInterval
+		w.lock.Unlock()
+		if policyChanged {
+			w.LoadPolicy()
+		}
+	}
+	self.metrics.Incr("config.updates", 1)
+	self.log.Info("registry config updated")
+	return nil
+}
+
+func (self *EtcdRegistry) Config() *Config {
+	return self.config.Load().(*Config)
+}
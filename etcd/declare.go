@@ -0,0 +1,283 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/coreos/etcd/client"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//声明的组: hasky在etcd中创建组并写入策略, 期望的成员缺失时记录告警事件,
+//组在etcd中被删除时重新创建为空组; hasky无法阻止直接对etcd的删除, leader与成员的状态随组一起丢失
+type GroupDefinition struct {
+	Name    string   //组名, 默认命名空间之外的组为 <namespace>/<group>
+	Members []string //期望的成员, 可以为空
+	Policy  string   //组策略json, 为空时不修改etcd中的策略
+	File    string   //定义所在的文件
+}
+
+//声明文件的格式, 一个文件可以定义多个组:
+//  [[group]]
+//  name = "devops-001"
+//  members = ["agent-01", "agent-02"]
+//  [[group.policy.probes]]
+//  type = "tcp"
+//  port = 8080
+type definitionFile struct {
+	Group []struct {
+		Name    string                 `toml:"name"`
+		Members []string               `toml:"members"`
+		Policy  map[string]interface{} `toml:"policy"`
+	} `toml:"group"`
+}
+
+//读取目录下所有 *.toml 文件中的组定义, 任何文件有错误时返回错误
+func LoadGroupDefinitions(dir string) ([]*GroupDefinition, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.toml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	defs := make([]*GroupDefinition, 0)
+	seen := make(map[string]string)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var content definitionFile
+		md, err := toml.Decode(string(data), &content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		//policy解码为map, 其中的key由策略的解析校验
+		keys := make([]string, 0)
+		for _, key := range md.Undecoded() {
+			if !strings.HasPrefix(key.String(), "group.policy.") {
+				keys = append(keys, key.String())
+			}
+		}
+		if len(keys) > 0 {
+			return nil, fmt.Errorf("%s: unknown keys: %s", file, strings.Join(keys, ", "))
+		}
+		for i, g := range content.Group {
+			def, err := newGroupDefinition(g.Name, g.Members, g.Policy)
+			if err != nil {
+				return nil, fmt.Errorf("%s: group #%d: %v", file, i+1, err)
+			}
+			if other, ok := seen[def.Name]; ok {
+				return nil, fmt.Errorf("%s: group %s is already defined in %s", file, def.Name, other)
+			}
+			seen[def.Name] = file
+			def.File = file
+			defs = append(defs, def)
+		}
+	}
+	return defs, nil
+}
+
+func newGroupDefinition(name string, members []string, policy map[string]interface{}) (*GroupDefinition, error) {
+	name = strings.Trim(strings.TrimSpace(name), "/")
+	if name == "" {
+		return nil, fmt.Errorf("missing group name")
+	}
+	if strings.Count(name, "/") > 1 {
+		return nil, fmt.Errorf("invalid group name %q, must be <group> or <namespace>/<group>", name)
+	}
+	def := &GroupDefinition{Name: name}
+	seen := make(map[string]bool)
+	for _, m := range members {
+		if m == "" || strings.Contains(m, "/") {
+			return nil, fmt.Errorf("invalid member name %q in group %s", m, name)
+		}
+		if seen[m] {
+			return nil, fmt.Errorf("duplicate member %s in group %s", m, name)
+		}
+		seen[m] = true
+		def.Members = append(def.Members, m)
+	}
+	if policy != nil {
+		//toml的表先转换为json, 由策略的解析统一校验
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := ParseGroupPolicy(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy of group %s: %v", name, err)
+		}
+		data, _ = json.Marshal(parsed)
+		def.Policy = string(data)
+	}
+	return def, nil
+}
+
+//设置声明的组并立即应用, 组不属于任何命名空间时返回错误且不做修改
+//从声明中移除的组不会从etcd中删除, 只是被删除后不再重新创建
+func (self *EtcdRegistry) SetGroupDefinitions(defs []*GroupDefinition) error {
+	declared := make(map[string]*GroupDefinition, len(defs))
+	for _, def := range defs {
+		path := self.namespaces.GroupPath(def.Name)
+		if self.namespaces.dirOf(path) == "" {
+			return fmt.Errorf("group %s (%s) is not in any namespace", def.Name, def.File)
+		}
+		declared[path] = def
+	}
+	self.lock.Lock()
+	previous := len(self.declared)
+	self.declared = declared
+	self.lock.Unlock()
+	if len(declared) > 0 || previous > 0 {
+		self.log.Info("group definitions loaded", "groups", len(declared))
+	}
+	self.applyDefinitions("declare")
+	return nil
+}
+
+//组的声明, 没有声明时返回nil
+func (self *EtcdRegistry) GetGroupDefinition(group string) *GroupDefinition {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.declared[self.namespaces.GroupPath(group)]
+}
+
+//声明的组缺失的成员: 没有注册或者已经dead
+func (self *EtcdRegistry) MissingMembers(group string) []string {
+	def := self.GetGroupDefinition(group)
+	if def == nil || len(def.Members) == 0 {
+		return nil
+	}
+	states := make(map[string]MemberState)
+	if w := self.getWorker(self.namespaces.GroupPath(group)); w != nil {
+		for _, status := range w.Snapshot().States {
+			states[status.Name] = status.State
+		}
+	}
+	missing := make([]string, 0)
+	for _, m := range def.Members {
+		if state, ok := states[m]; !ok || state == STATE_DEAD {
+			missing = append(missing, m)
+		}
+	}
+	return missing
+}
+
+func (self *EtcdRegistry) declaredGroups() map[string]*GroupDefinition {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.declared
+}
+
+//确保声明的组存在于etcd且策略一致, reason用于事件与日志
+func (self *EtcdRegistry) applyDefinitions(reason string) {
+	for path, def := range self.declaredGroups() {
+		self.applyDefinition(path, def, reason)
+	}
+}
+
+func (self *EtcdRegistry) applyDefinition(path string, def *GroupDefinition, reason string) {
+	if !self.registryClient.IsDirExist(path + "/members") {
+		if err := self.registryClient.CreateDir(path + "/members"); err != nil && !isNodeExist(err) {
+			self.log.Error("create declared group failed", "group", path, "error", err)
+			return
+		}
+		//首次加载之后组仍不存在, 说明组在etcd中被删除了
+		typ := EVENT_GROUP_DECLARED
+		if reason != "declare" {
+			typ = EVENT_GROUP_RESTORED
+		}
+		self.metrics.Incr("declare.groups_created", 1)
+		self.events.Add(typ, path, "", "%s: group created from %s", reason, def.File)
+		self.log.Info("declared group created", "group", path, "reason", reason)
+	}
+	if def.Policy == "" {
+		return
+	}
+	current, err := self.registryClient.Get(path + "/policy")
+	if err == nil && samePolicy(current, def.Policy) {
+		return
+	}
+	if err != nil && !client.IsKeyNotFound(err) {
+		self.log.Error("read group policy failed", "group", path, "error", err)
+		return
+	}
+	if err := self.registryClient.Set(path+"/policy", def.Policy); err != nil {
+		self.log.Error("write declared policy failed", "group", path, "error", err)
+		return
+	}
+	self.metrics.Incr("declare.policies_written", 1)
+	self.events.Add(EVENT_GROUP_DECLARED, path, "", "%s: policy written from %s", reason, def.File)
+}
+
+//声明的组在etcd中被删除后重新创建, lost为删除前的worker状态
+//重新创建的组没有leader与成员, 直到成员重新写入心跳, 因此记录丢失的leader
+func (self *EtcdRegistry) restoreDeclaredGroup(path string, def *GroupDefinition, lost *WorkerSnapshot) {
+	leader, members := "", 0
+	if lost != nil {
+		leader, members = lost.WorkingNode, len(lost.Members)
+	}
+	self.metrics.Incr("declare.groups_deleted", 1)
+	self.events.Add(EVENT_GROUP_DELETED, path, leader,
+		"declared group deleted from etcd, leader [%s] and %d members lost", leader, members)
+	self.log.Warn("declared group deleted from etcd, leadership lost", "group", path, "leader", leader, "members", members)
+	self.applyDefinition(path, def, "restore")
+}
+
+//两个策略解析后相同, etcd中的策略可能是手工写入的不同格式
+func samePolicy(a, b string) bool {
+	pa, err := ParseGroupPolicy(a)
+	if err != nil {
+		return false
+	}
+	pb, err := ParseGroupPolicy(b)
+	if err != nil {
+		return false
+	}
+	da, _ := json.Marshal(pa)
+	db, _ := json.Marshal(pb)
+	return string(da) == string(db)
+}
+
+//检查声明的成员, 缺失的成员发生变化时记录告警事件
+func (self *EtcdRegistry) checkDeclaredMembers() {
+	declared := self.declaredGroups()
+	total := 0
+	for path := range declared {
+		missing := self.MissingMembers(path)
+		total += len(missing)
+		key := strings.Join(missing, ",")
+
+		self.lock.Lock()
+		last, ok := self.missingReported[path]
+		self.missingReported[path] = key
+		self.lock.Unlock()
+		switch {
+		case key == last:
+		case key != "":
+			self.events.Add(EVENT_MEMBER_MISSING, path, "", "declared members missing: %s", key)
+			self.log.Warn("declared members missing", "group", path, "members", key)
+		case ok:
+			self.events.Add(EVENT_MEMBER_MISSING, path, "", "all declared members present")
+			self.log.Info("all declared members present", "group", path)
+		}
+	}
+	self.lock.Lock()
+	for path := range self.missingReported {
+		if declared[path] == nil {
+			delete(self.missingReported, path)
+		}
+	}
+	self.lock.Unlock()
+	self.metrics.Set("declare.missing_members", int64(total))
+}
+
+func isNodeExist(err error) bool {
+	if e, ok := err.(client.Error); ok {
+		return e.Code == client.ErrorCodeNodeExist
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package etcd
+
+import (
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+	"time"
+)
+
+//声明的组被删除后重新创建为空组, 并记录丢失的leader
+func TestDeclaredGroupDeleted(t *testing.T) {
+	backend := NewMemoryBackend()
+	registry := newTestRegistry(t, backend)
+	if err := registry.SetGroupDefinitions([]*GroupDefinition{{Name: "web", Members: []string{"agent-1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	group := registry.Namespaces().Dirs()[0] + "/web"
+	backend.Set(group+"/members/agent-1/heartbeat", testHeartbeat(time.Now()))
+	backend.Set(group+"/leader", "agent-1")
+
+	registry.Start(context.Background())
+	defer registry.Close()
+	waitFor(t, "worker with leader", func() bool {
+		snapshot := registry.GetWorkerSnapshot(group)
+		return snapshot != nil && snapshot.WorkingNode == "agent-1"
+	})
+
+	backend.DeleteDir(group)
+	waitFor(t, "group deleted event", func() bool {
+		for _, e := range registry.Events().List(0, group, 0) {
+			if e.Type == EVENT_GROUP_DELETED && e.Member == "agent-1" && strings.Contains(e.Message, "leader [agent-1]") {
+				return true
+			}
+		}
+		return false
+	})
+	if !backend.IsDirExist(group + "/members") {
+		t.Fatal("declared group not re-created")
+	}
+	if leader, _ := backend.Get(group + "/leader"); leader != "" {
+		t.Fatalf("re-created group has leader %s", leader)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,95 @@
+package etcd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//最多保留的事件数
+const EVENT_LOG_SIZE = 1024
+
+const (
+	//事件类型
+	EVENT_RECONCILE_ADD    = "reconcile.add"
+	EVENT_RECONCILE_REMOVE = "reconcile.remove"
+	EVENT_RECONCILE_LEADER = "reconcile.leader"
+	EVENT_FAILOVER         = "failover"
+	EVENT_SWITCHOVER       = "switchover"
+	EVENT_FLAP             = "flap"
+	EVENT_DAMPING          = "damping"
+	EVENT_SUPPRESSED       = "failover.suppressed"
+	EVENT_CLOCK_SUSPECT    = "clock.suspect"
+	EVENT_GROUP_DECLARED   = "group.declared"
+	EVENT_GROUP_RESTORED   = "group.restored"
+	EVENT_GROUP_DELETED    = "group.deleted"
+	EVENT_MEMBER_MISSING   = "member.missing"
+)
+
+//注册中心事件
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Group   string    `json:"group,omitempty"`
+	Member  string    `json:"member,omitempty"`
+	Message string    `json:"message"`
+}
+
+//定长的事件环形缓冲
+type EventLog struct {
+	lock       sync.RWMutex
+	events     []*Event
+	seq        uint64
+	namespaces *Namespaces
+}
+
+func NewEventLog() *EventLog {
+	return &EventLog{events: make([]*Event, 0, EVENT_LOG_SIZE), namespaces: DefaultNamespaces()}
+}
+
+//事件中的组名按命名空间转换为短名称
+func (l *EventLog) setNamespaces(namespaces *Namespaces) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.namespaces = namespaces
+}
+
+func (l *EventLog) Add(typ, group, member string, format string, args ...interface{}) *Event {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.seq++
+	e := &Event{
+		Seq:     l.seq,
+		Time:    time.Now(),
+		Type:    typ,
+		Group:   l.namespaces.GroupName(group),
+		Member:  member,
+		Message: fmt.Sprintf(format, args...),
+	}
+	if len(l.events) < EVENT_LOG_SIZE {
+		l.events = append(l.events, e)
+	} else {
+		l.events[int((l.seq-1)%EVENT_LOG_SIZE)] = e
+	}
+	return e
+}
+
+//按序号升序返回since之后的事件, group为空时不过滤, limit<=0时不限制条数
+func (l *EventLog) List(since uint64, group string, limit int) []*Event {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	result := make([]*Event, 0)
+	n := len(l.events)
+	for i := 0; i < n; i++ {
+		e := l.events[int((l.seq-uint64(n)+uint64(i))%EVENT_LOG_SIZE)]
+		if e.Seq <= since || (group != "" && e.Group != l.namespaces.GroupName(l.namespaces.GroupPath(group))) {
+			continue
+		}
+		result = append(result, e)
+	}
+	if limit > 0 && len(result) > limit {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
@@ -0,0 +1,53 @@
+package etcd
+
+import (
+	"flag"
+	"strings"
+)
+
+//直接连接etcd的子命令(doctor、snapshot)共用的连接参数, 名称与hasky的参数一致
+type ClientFlags struct {
+	endpoint   *string
+	prefix     *string
+	namespaces *string
+	certFile   *string
+	keyFile    *string
+	caFile     *string
+	username   *string
+	password   *string
+}
+
+//在flagSet中注册连接参数
+func NewClientFlags(flagSet *flag.FlagSet) *ClientFlags {
+	return &ClientFlags{
+		endpoint:   flagSet.String("etcd-endpoint", "0.0.0.0:2379", "comma separated etcd endpoints"),
+		prefix:     flagSet.String("etcd-prefix", DEFAULT_ETCD_PREFIX, "root path of all keys hasky reads and writes in etcd"),
+		namespaces: flagSet.String("namespaces", DEFAULT_NAMESPACE, "comma separated namespaces under etcd-prefix"),
+		certFile:   flagSet.String("etcd-cert", "", "client certificate file for etcd tls"),
+		keyFile:    flagSet.String("etcd-key", "", "client key file for etcd tls"),
+		caFile:     flagSet.String("etcd-cacert", "", "CA bundle to verify the etcd server certificate"),
+		username:   flagSet.String("etcd-username", "", "username for etcd authentication"),
+		password:   flagSet.String("etcd-password", "", "password for etcd authentication"),
+	}
+}
+
+//根据解析后的参数连接etcd, 返回使用的命名空间
+func (f *ClientFlags) Connect() (*Namespaces, error) {
+	namespaces, err := NewNamespaces(*f.prefix, strings.Split(*f.namespaces, ","))
+	if err != nil {
+		return nil, err
+	}
+	err = Init(&ClientConfig{
+		Endpoints:  strings.Split(*f.endpoint, ","),
+		CertFile:   *f.certFile,
+		KeyFile:    *f.keyFile,
+		CAFile:     *f.caFile,
+		Username:   *f.username,
+		Password:   *f.password,
+		Namespaces: namespaces,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,136 @@
+package etcd
+
+import (
+	"time"
+)
+
+//抖动检测:
+//成员在 FlapWindow 内从healthy变为不健康达到 FlapThreshold 次时被隔离, 隔离期间不参与选举,
+//一次正常的重启(healthy->suspect->dead->joining->healthy)只计为一次,
+//再次抖动时隔离时间加倍, 最长 FlapQuarantineMax;
+//组在 FlapWindow 内切换达到 GroupFlapThreshold 次时, GroupDamping 内不再切换
+
+//组的抑制状态
+type DampingStatus struct {
+	Group       string           `json:"group"`
+	Failovers   int              `json:"failovers"`
+	Damped      bool             `json:"damped"`
+	DampedUntil time.Time        `json:"damped_until"`
+	Members     []*MemberDamping `json:"members"`
+}
+
+//成员的隔离状态
+type MemberDamping struct {
+	Name             string    `json:"name"`
+	Flaps            int       `json:"flaps"`
+	Quarantined      bool      `json:"quarantined"`
+	QuarantinedUntil time.Time `json:"quarantined_until"`
+}
+
+//统计窗口内从healthy变为suspect或dead的次数, 新进入隔离时返回true
+//恢复过程中的变化(dead->joining->healthy)、管理员设置的状态以及上一次隔离结束之前的变化不计入
+func (t *memberTracker) checkFlap(now time.Time, cfg *Config) bool {
+	since := now.Add(-cfg.FlapWindow)
+	if t.status.QuarantinedUntil.After(since) {
+		since = t.status.QuarantinedUntil
+	}
+	count := 0
+	for _, h := range t.status.History {
+		if h.Time.After(since) && h.From == STATE_HEALTHY && (h.To == STATE_SUSPECT || h.To == STATE_DEAD) {
+			count++
+		}
+	}
+	t.status.Flaps = count
+	if count < cfg.FlapThreshold || t.quarantined(now) {
+		return false
+	}
+	//上一次隔离结束后稳定超过一个窗口, 隔离时间重新计算
+	if now.Sub(t.status.QuarantinedUntil) > cfg.FlapWindow {
+		t.quarantines = 0
+	}
+	backoff := cfg.FlapQuarantineMin << uint(t.quarantines)
+	if backoff > cfg.FlapQuarantineMax || backoff <= 0 {
+		backoff = cfg.FlapQuarantineMax
+	}
+	t.quarantines++
+	t.status.QuarantinedUntil = now.Add(backoff)
+	return true
+}
+
+func (t *memberTracker) quarantined(now time.Time) bool {
+	return now.Before(t.status.QuarantinedUntil)
+}
+
+func isAdminState(state MemberState) bool {
+	return state == STATE_DISABLED || state == STATE_DRAINING
+}
+
+//成员状态变化后检查抖动, 调用方需持有锁
+func (self *LeaderWorker) checkFlap(t *memberTracker, now time.Time) {
+	cfg := self.registry.Config()
+	if t.checkFlap(now, cfg) {
+		backoff := t.status.QuarantinedUntil.Sub(now)
+		self.log.Warn("member flapping, quarantined", "member", t.status.Name,
+			"flaps", t.status.Flaps, "window", cfg.FlapWindow, "quarantine", backoff)
+		self.registry.metrics.Incr("flap.quarantines", 1)
+		self.registry.events.Add(EVENT_FLAP, self.Group, t.status.Name,
+			"unhealthy %d times in %s, quarantined for %s", t.status.Flaps, cfg.FlapWindow, backoff)
+	}
+}
+
+//记录一次切换, 窗口内切换过多时开始抑制
+func (self *LeaderWorker) recordFailover(now time.Time) {
+	cfg := self.registry.Config()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.failovers = append(self.failovers, now)
+	self.trimFailovers(now)
+	if len(self.failovers) >= cfg.GroupFlapThreshold && !now.Before(self.dampedUntil) {
+		self.dampedUntil = now.Add(cfg.GroupDamping)
+		self.log.Warn("group flapping, failover damped", "failovers", len(self.failovers), "window", cfg.FlapWindow, "damping", cfg.GroupDamping)
+		self.registry.metrics.Incr("flap.dampings", 1)
+		self.registry.events.Add(EVENT_DAMPING, self.Group, "",
+			"%d failovers in %s, failover damped for %s", len(self.failovers), cfg.FlapWindow, cfg.GroupDamping)
+	}
+}
+
+//移除窗口外的切换记录, 调用方需持有锁
+func (self *LeaderWorker) trimFailovers(now time.Time) {
+	since := now.Add(-self.registry.Config().FlapWindow)
+	i := 0
+	for i < len(self.failovers) && !self.failovers[i].After(since) {
+		i++
+	}
+	self.failovers = self.failovers[i:]
+}
+
+//组当前是否处于抑制期
+func (self *LeaderWorker) damped(now time.Time) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return now.Before(self.dampedUntil)
+}
+
+//组与成员的抑制状态
+func (self *LeaderWorker) Damping() *DampingStatus {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.trimFailovers(now)
+	status := &DampingStatus{
+		Group:       self.registry.namespaces.GroupName(self.Group),
+		Failovers:   len(self.failovers),
+		Damped:      now.Before(self.dampedUntil),
+		DampedUntil: self.dampedUntil,
+		Members:     make([]*MemberDamping, 0, len(self.states)),
+	}
+	for _, s := range self.memberStatuses() {
+		status.Members = append(status.Members, &MemberDamping{
+			Name:             s.Name,
+			Flaps:            s.Flaps,
+			Quarantined:      now.Before(s.QuarantinedUntil),
+			QuarantinedUntil: s.QuarantinedUntil,
+		})
+	}
+	return status
+}
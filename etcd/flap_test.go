@@ -0,0 +1,90 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+)
+
+const (
+	flapSuspect = 3 * time.Second
+	flapDead    = 10 * time.Second
+)
+
+//按心跳驱动状态机的成员, 每次写入心跳使用新的修改序号
+type flapMember struct {
+	worker  *LeaderWorker
+	tracker *memberTracker
+	index   uint64
+	now     time.Time
+}
+
+func newFlapMember(t *testing.T) *flapMember {
+	registry := newTestRegistry(t, NewMemoryBackend())
+	m := &flapMember{
+		worker: NewLeaderWorker(registry, time.Second, registry.Namespaces().Dirs()[0]+"/group"),
+		now:    time.Now(),
+	}
+	m.worker.lock.Lock()
+	defer m.worker.lock.Unlock()
+	m.tracker = m.worker.tracker("agent-1", m.now)
+	m.heartbeat(0)
+	m.heartbeat(time.Second)
+	if m.tracker.status.State != STATE_HEALTHY {
+		t.Fatalf("member is %s, want healthy", m.tracker.status.State)
+	}
+	return m
+}
+
+func (m *flapMember) heartbeat(after time.Duration) {
+	m.now = m.now.Add(after)
+	m.index++
+	m.tracker.observeHeartbeat(testHeartbeat(m.now), m.index, m.now)
+}
+
+func (m *flapMember) silence(after time.Duration) {
+	m.now = m.now.Add(after)
+	m.tracker.checkAge(m.now, flapSuspect, flapDead)
+}
+
+//一次完整的宕机与恢复只计为一次, 不会被隔离
+func TestFlapOutageNotQuarantined(t *testing.T) {
+	m := newFlapMember(t)
+	m.worker.lock.Lock()
+	defer m.worker.lock.Unlock()
+
+	m.silence(flapSuspect + time.Second)
+	m.silence(flapDead - flapSuspect)
+	if m.tracker.status.State != STATE_DEAD {
+		t.Fatalf("member is %s, want dead", m.tracker.status.State)
+	}
+	m.heartbeat(time.Second)
+	m.heartbeat(time.Second)
+	if m.tracker.status.State != STATE_HEALTHY {
+		t.Fatalf("member is %s, want healthy", m.tracker.status.State)
+	}
+	if m.tracker.quarantined(m.now) || m.tracker.status.Flaps != 1 {
+		t.Fatalf("outage counted as %d flaps, quarantined until %s", m.tracker.status.Flaps, m.tracker.status.QuarantinedUntil)
+	}
+}
+
+//窗口内反复变为不健康达到阈值时隔离
+func TestFlapOscillationQuarantined(t *testing.T) {
+	m := newFlapMember(t)
+	m.worker.lock.Lock()
+	defer m.worker.lock.Unlock()
+
+	threshold := m.worker.registry.Config().FlapThreshold
+	for i := 1; i <= threshold; i++ {
+		m.silence(flapSuspect + time.Second)
+		if m.tracker.status.State != STATE_SUSPECT {
+			t.Fatalf("member is %s, want suspect", m.tracker.status.State)
+		}
+		if quarantined := m.tracker.quarantined(m.now); quarantined != (i == threshold) {
+			t.Fatalf("after %d flaps quarantined = %v", i, quarantined)
+		}
+		m.heartbeat(time.Second)
+	}
+	if got := m.tracker.status.QuarantinedUntil.Sub(m.now); got <= 0 || got > FLAP_QUARANTINE_MIN {
+		t.Fatalf("quarantined for %s, want up to %s", got, FLAP_QUARANTINE_MIN)
+	}
+}
@@ -0,0 +1,182 @@
+package etcd
+
+import (
+	"fmt"
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"sync"
+	"time"
+)
+
+//切换保护: 以下情况说明问题更可能出在hasky自身, 此时拒绝切换leader
+//1. 无法稳定访问etcd
+//2. 短时间内大部分成员同时失效
+//3. 本机时钟发生跳变, 或者进程被暂停过
+type failoverGuard struct {
+	lock         sync.Mutex
+	lastContact  time.Time
+	failures     int
+	clockSuspect time.Time
+	clockReason  string
+	staleAt      time.Time
+	stale        int
+	total        int
+}
+
+//切换保护的状态
+type GuardStatus struct {
+	EtcdReachable     bool      `json:"etcd_reachable"`
+	LastContact       time.Time `json:"last_contact"`
+	ContactFailures   int       `json:"contact_failures"`
+	StaleMembers      int       `json:"stale_members"`
+	TotalMembers      int       `json:"total_members"`
+	MaxStaleFraction  float64   `json:"max_stale_fraction"`
+	ClockSuspect      bool      `json:"clock_suspect"`
+	ClockSuspectUntil time.Time `json:"clock_suspect_until"`
+	ClockReason       string    `json:"clock_reason,omitempty"`
+	FailoverAllowed   bool      `json:"failover_allowed"`
+	Reason            string    `json:"reason,omitempty"`
+}
+
+func newFailoverGuard() *failoverGuard {
+	return &failoverGuard{lastContact: time.Now()}
+}
+
+//与etcd交互成功
+func (g *failoverGuard) contact(now time.Time) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.lastContact = now
+	g.failures = 0
+}
+
+//与etcd交互失败
+func (g *failoverGuard) failure() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.failures++
+}
+
+//时钟异常, 一段时间内不允许切换
+func (g *failoverGuard) suspectClock(now time.Time, period time.Duration, reason string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.clockSuspect = now.Add(period)
+	g.clockReason = reason
+}
+
+//定期访问etcd确认连接正常, 同时检查本机时钟
+//检查时钟使用本次等待的间隔, 避免修改参数后误判
+func (self *EtcdRegistry) watchdog(ctx context.Context) {
+	last := time.Now()
+	interval := func() time.Duration { return self.Config().GuardPingInterval }
+	TickEvery(ctx, interval, func(waited time.Duration) {
+		now := time.Now()
+		self.checkClock(last, now, waited)
+		last = now
+
+		if _, err := self.registryClient.Get(self.namespaces.Prefix()); err == nil || client.IsKeyNotFound(err) {
+			self.guard.contact(time.Now())
+		} else {
+			self.guard.failure()
+			self.logger.Named("guard").Warn("ping etcd failed", "error", err)
+		}
+	})
+}
+
+//比较两次检查之间的单调时钟与墙上时钟:
+//两者相差过大说明时钟被调整过, 单调时钟的间隔过长说明进程被暂停过
+func (self *EtcdRegistry) checkClock(last, now time.Time, interval time.Duration) {
+	cfg := self.Config()
+	elapsed := now.Sub(last)
+	wall := now.Round(0).Sub(last.Round(0))
+	reason := ""
+	switch {
+	case wall-elapsed > cfg.ClockJumpTolerance || elapsed-wall > cfg.ClockJumpTolerance:
+		reason = fmt.Sprintf("wall clock jumped %s", wall-elapsed)
+	case elapsed > interval+cfg.ClockJumpTolerance:
+		reason = fmt.Sprintf("process paused for %s", elapsed-interval)
+	}
+	if reason != "" {
+		self.logger.Named("guard").Warn("clock suspect, failover disabled", "reason", reason, "period", cfg.ClockSuspectPeriod)
+		self.guard.suspectClock(now, cfg.ClockSuspectPeriod, reason)
+		self.metrics.Incr("guard.clock_suspects", 1)
+		self.events.Add(EVENT_CLOCK_SUSPECT, "", "", "%s, failover disabled for %s", reason, cfg.ClockSuspectPeriod)
+	}
+}
+
+//统计所有组中近期失效的成员数, 结果缓存一段时间
+func (self *EtcdRegistry) staleMembers(now time.Time) (int, int) {
+	self.guard.lock.Lock()
+	if now.Sub(self.guard.staleAt) < GUARD_STALE_CACHE {
+		defer self.guard.lock.Unlock()
+		return self.guard.stale, self.guard.total
+	}
+	self.guard.lock.Unlock()
+
+	//状态尚未推进的成员按心跳间隔判断, 避免各组检查的先后影响统计
+	stale, total := 0, 0
+	window := self.Config().MassStaleWindow
+	since := now.Add(-window)
+	for _, w := range self.workerList() {
+		w.lock.RLock()
+		suspectTimeout := w.suspectTimeout()
+		for _, t := range w.states {
+			if t.isAdminState() {
+				continue
+			}
+			total++
+			age := now.Sub(t.lastChange)
+			switch {
+			case (t.status.State == STATE_SUSPECT || t.status.State == STATE_DEAD) && t.status.Since.After(since):
+				stale++
+			case age > suspectTimeout && age <= suspectTimeout+window:
+				stale++
+			}
+		}
+		w.lock.RUnlock()
+	}
+
+	self.guard.lock.Lock()
+	defer self.guard.lock.Unlock()
+	self.guard.stale, self.guard.total, self.guard.staleAt = stale, total, now
+	return stale, total
+}
+
+//切换保护的当前状态
+func (self *EtcdRegistry) GuardStatus() *GuardStatus {
+	now := time.Now()
+	stale, total := self.staleMembers(now)
+
+	cfg := self.Config()
+	g := self.guard
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	status := &GuardStatus{
+		EtcdReachable:     g.failures < cfg.GuardMaxFailures && now.Sub(g.lastContact) < cfg.GuardContactTimeout,
+		LastContact:       g.lastContact,
+		ContactFailures:   g.failures,
+		StaleMembers:      stale,
+		TotalMembers:      total,
+		MaxStaleFraction:  cfg.FailoverMaxStaleFraction,
+		ClockSuspect:      now.Before(g.clockSuspect),
+		ClockSuspectUntil: g.clockSuspect,
+		ClockReason:       g.clockReason,
+	}
+	switch {
+	case !status.EtcdReachable:
+		status.Reason = fmt.Sprintf("etcd unreachable, last contact %s ago", now.Sub(g.lastContact).Truncate(time.Millisecond))
+	case status.ClockSuspect:
+		status.Reason = "clock suspect: " + g.clockReason
+	case total >= cfg.MassStaleMinMembers && float64(stale) > cfg.FailoverMaxStaleFraction*float64(total):
+		status.Reason = fmt.Sprintf("%d of %d members went stale within %s", stale, total, cfg.MassStaleWindow)
+	}
+	status.FailoverAllowed = status.Reason == ""
+	return status
+}
+
+//是否允许切换, 不允许时返回原因
+func (self *EtcdRegistry) failoverAllowed() (bool, string) {
+	status := self.GuardStatus()
+	return status.FailoverAllowed, status.Reason
+}
@@ -0,0 +1,116 @@
+package etcd
+
+import (
+	"fmt"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+//etcd连续访问失败时拒绝切换, 恢复访问后允许
+func TestGuardEtcdUnreachable(t *testing.T) {
+	registry := newTestRegistry(t, NewMemoryBackend())
+	for i := 0; i < registry.Config().GuardMaxFailures; i++ {
+		if allowed, _ := registry.failoverAllowed(); !allowed {
+			t.Fatalf("failover refused after %d failures", i)
+		}
+		registry.guard.failure()
+	}
+	if allowed, reason := registry.failoverAllowed(); allowed || reason == "" {
+		t.Fatal("failover allowed while etcd is unreachable")
+	}
+	registry.guard.contact(time.Now())
+	if allowed, reason := registry.failoverAllowed(); !allowed {
+		t.Fatalf("failover refused after contact: %s", reason)
+	}
+}
+
+//进程被暂停过时, 在 clock-suspect-period 内拒绝切换
+func TestGuardProcessPaused(t *testing.T) {
+	registry := newTestRegistry(t, NewMemoryBackend())
+	cfg := registry.Config()
+	now := time.Now()
+	registry.checkClock(now.Add(-cfg.GuardPingInterval), now, cfg.GuardPingInterval)
+	if allowed, reason := registry.failoverAllowed(); !allowed {
+		t.Fatalf("failover refused after a regular tick: %s", reason)
+	}
+
+	registry.checkClock(now.Add(-cfg.GuardPingInterval-cfg.ClockJumpTolerance-time.Second), now, cfg.GuardPingInterval)
+	status := registry.GuardStatus()
+	if status.FailoverAllowed || !status.ClockSuspect || !status.ClockSuspectUntil.Equal(now.Add(cfg.ClockSuspectPeriod)) {
+		t.Fatalf("guard status after pause = %+v", status)
+	}
+	if events := registry.Events().List(0, "", 0); len(events) != 1 || events[0].Type != EVENT_CLOCK_SUSPECT {
+		t.Fatalf("events = %v", events)
+	}
+}
+
+//组内5个成员都为healthy, leader与另外stale-1个成员刚变为suspect
+func guardedGroup(t *testing.T, stale int) (*EtcdRegistry, *LeaderWorker) {
+	backend := NewMemoryBackend()
+	registry := newTestRegistry(t, backend)
+	cfg := *registry.Config()
+	cfg.MassStaleMinMembers = 5
+	cfg.FailoverMaxStaleFraction = 0.5
+	if err := registry.UpdateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	group := registry.Namespaces().Dirs()[0] + "/group"
+	members := []string{"agent-1", "agent-2", "agent-3", "agent-4", "agent-5"}
+	for _, m := range members {
+		backend.Set(group+"/members/"+m+"/heartbeat", "agent-hb-1")
+	}
+	backend.Set(group+"/leader", members[0])
+	registry.registWorker(group)
+	w := registry.getWorker(group)
+
+	now := time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.KeepalivePeriod = time.Minute
+	for i, m := range members {
+		tracker := w.states[m]
+		tracker.observeHeartbeat("agent-hb-2", uint64(100+i), now)
+		if tracker.status.State != STATE_HEALTHY {
+			t.Fatalf("%s is %s, want healthy", m, tracker.status.State)
+		}
+		if i < stale {
+			tracker.checkAge(now.Add(w.suspectTimeout()+time.Second), w.suspectTimeout(), w.deadTimeout())
+		}
+	}
+	return registry, w
+}
+
+//大部分成员同时失效时拒绝切换并记录事件, 只有leader失效时正常切换
+func TestGuardMassStale(t *testing.T) {
+	for _, c := range []struct {
+		stale   int
+		allowed bool
+	}{
+		{1, true},
+		{4, false},
+	} {
+		t.Run(fmt.Sprintf("stale-%d", c.stale), func(t *testing.T) {
+			registry, w := guardedGroup(t, c.stale)
+			w.Keepalive(context.Background())
+
+			submitted := registry.Metrics().Get("scheduler.submitted")
+			suppressed := registry.Events().List(0, w.Group, 0)
+			if c.allowed {
+				if submitted != 1 || len(suppressed) != 0 {
+					t.Fatalf("failover not submitted: submitted=%d events=%v", submitted, suppressed)
+				}
+				return
+			}
+			if submitted != 0 {
+				t.Fatal("failover submitted while most members are stale")
+			}
+			if len(suppressed) != 1 || suppressed[0].Type != EVENT_SUPPRESSED {
+				t.Fatalf("events = %v, want one %s", suppressed, EVENT_SUPPRESSED)
+			}
+			if w.getWorkingNode() != "agent-1" {
+				t.Fatalf("leader changed to %s", w.getWorkingNode())
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/coreos/etcd/client"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//成员元数据, 由agent写入 <group>/members/<member>/meta
+type MemberMeta struct {
+	Address   string   `json:"address,omitempty"`
+	Port      int      `json:"port,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	Zone      string   `json:"zone,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	StartTime int64    `json:"start_time,omitempty"`
+}
+
+//成员信息
+type MemberInfo struct {
+	Group         string      `json:"group"`
+	Name          string      `json:"name"`
+	Meta          *MemberMeta `json:"meta,omitempty"`
+	Leader        bool        `json:"leader"`
+	Healthy       bool        `json:"healthy"`
+	State         MemberState `json:"state,omitempty"`
+	StateSince    time.Time   `json:"state_since"`
+	StateReason   string      `json:"state_reason,omitempty"`
+	LastHeartbeat time.Time   `json:"last_heartbeat"`
+}
+
+//成员查询条件
+type MemberQuery struct {
+	Group  string
+	Zone   string
+	Tags   []string
+	Health string
+	State  string
+}
+
+func ParseMemberMeta(value string) (*MemberMeta, error) {
+	meta := &MemberMeta{}
+	if err := json.Unmarshal([]byte(value), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+//成员的访问地址, 没有元数据时使用成员名称
+func (m *MemberMeta) Endpoint(member string) string {
+	if m == nil || m.Address == "" {
+		return member
+	}
+	if m.Port > 0 {
+		return net.JoinHostPort(m.Address, strconv.Itoa(m.Port))
+	}
+	return m.Address
+}
+
+func (m *MemberMeta) HasTag(tag string) bool {
+	if m == nil {
+		return false
+	}
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *MemberQuery) Match(m *MemberInfo) bool {
+	if q.Zone != "" && (m.Meta == nil || m.Meta.Zone != q.Zone) {
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !m.Meta.HasTag(tag) {
+			return false
+		}
+	}
+	if q.State != "" && string(m.State) != q.State {
+		return false
+	}
+	switch q.Health {
+	case "healthy":
+		return m.Healthy
+	case "unhealthy":
+		return !m.Healthy
+	}
+	return true
+}
+
+//列出组内所有成员
+func (self *EtcdRegistry) ListMembers(group string) ([]*MemberInfo, error) {
+	group = self.namespaces.GroupPath(group)
+	//有worker跟踪时直接使用内存中的成员状态
+	if w := self.getWorker(group); w != nil {
+		w.lock.RLock()
+		defer w.lock.RUnlock()
+		return w.memberInfos(), nil
+	}
+	node, err := self.registryClient.GetTree(group)
+	if err != nil {
+		return nil, err
+	}
+	return self.parseMembers(group, node), nil
+}
+
+//从组的节点树中解析成员信息
+func (self *EtcdRegistry) parseMembers(group string, node *client.Node) []*MemberInfo {
+	leader := ""
+	members := make([]*MemberInfo, 0)
+	for _, n := range node.Nodes {
+		switch n.Key {
+		case group + "/leader":
+			leader = n.Value
+		case group + "/members":
+			for _, mn := range n.Nodes {
+				if !mn.Dir {
+					continue
+				}
+				members = append(members, self.newMemberInfo(group, mn.Key, mn.Nodes))
+			}
+		}
+	}
+	for _, m := range members {
+		m.Leader = m.Name == leader
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+func (self *EtcdRegistry) newMemberInfo(group, memberDir string, files []*client.Node) *MemberInfo {
+	m := &MemberInfo{
+		Group: self.namespaces.GroupName(group),
+		Name:  memberDir[strings.LastIndex(memberDir, "/")+1:],
+	}
+	for _, f := range files {
+		switch f.Key {
+		case memberDir + "/meta":
+			meta, err := ParseMemberMeta(f.Value)
+			if err != nil {
+				self.log.Error("invalid member meta", "group", group, "member", m.Name, "error", err)
+				continue
+			}
+			m.Meta = meta
+		case memberDir + "/heartbeat":
+			hb, err := ParseHeartbeat(f.Value)
+			if err != nil {
+				continue
+			}
+			m.LastHeartbeat = hb
+			m.Healthy = time.Since(hb) <= self.Config().MemberHeartbeatTimeout
+		}
+	}
+	return m
+}
+
+//按条件查询成员
+func (self *EtcdRegistry) QueryMembers(q *MemberQuery) ([]*MemberInfo, error) {
+	var groups []string
+	if q.Group != "" {
+		groups = []string{self.namespaces.GroupPath(q.Group)}
+	} else {
+		for _, dir := range self.namespaces.Dirs() {
+			children, err := self.registryClient.GetDirChildren(dir)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, children...)
+		}
+		sort.Strings(groups)
+	}
+
+	result := make([]*MemberInfo, 0)
+	for _, group := range groups {
+		members, err := self.ListMembers(group)
+		if err != nil {
+			if q.Group != "" {
+				return nil, err
+			}
+			self.log.Error("list members failed", "group", group, "error", err)
+			continue
+		}
+		for _, m := range members {
+			if q.Match(m) {
+				result = append(result, m)
+			}
+		}
+	}
+	return result, nil
+}
+
+//管理员设置成员状态: disabled/draining, 为空时恢复正常
+func (self *EtcdRegistry) SetMemberAdminState(group, member string, state MemberState) error {
+	if err := self.namespaces.CheckGroup(group); err != nil {
+		return err
+	}
+	if err := CheckName(member); err != nil {
+		return err
+	}
+	group = self.namespaces.GroupPath(group)
+	memberDir := group + "/members/" + member
+	if path.Clean(memberDir) != memberDir || path.Dir(path.Dir(memberDir)) != group {
+		return fmt.Errorf("member %s is outside of %s", member, self.namespaces.GroupName(group))
+	}
+	if !self.registryClient.IsDirExist(memberDir) {
+		return fmt.Errorf("member %s not found in %s", member, self.namespaces.GroupName(group))
+	}
+	stateFile := memberDir + "/state"
+	switch state {
+	case STATE_DISABLED, STATE_DRAINING:
+		return self.registryClient.Set(stateFile, string(state))
+	case "":
+		if err := self.registryClient.Delete(stateFile); err != nil && !client.IsKeyNotFound(err) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid admin state: %s", state)
+}
+
+//获取成员的元数据
+func (self *EtcdRegistry) GetMemberMeta(group, member string) (*MemberMeta, error) {
+	value, err := self.registryClient.Get(group + "/members/" + member + "/meta")
+	if err != nil {
+		return nil, err
+	}
+	return ParseMemberMeta(value)
+}
@@ -0,0 +1,437 @@
+package etcd
+
+import (
+	"github.com/coreos/etcd/client"
+	"golang.org/x/net/context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//单个watcher最多缓存的事件数, 超出后与etcd一样返回 EventIndexCleared
+const MEMORY_WATCH_BUFFER = 4096
+
+//进程内的存储后端, 行为与etcd v2的keys api保持一致, 用于模拟与压测
+type MemoryBackend struct {
+	lock     sync.Mutex
+	ops      uint64
+	index    uint64
+	root     *memNode
+	watchers map[*memWatcher]struct{}
+}
+
+type memNode struct {
+	key           string
+	dir           bool
+	value         string
+	createdIndex  uint64
+	modifiedIndex uint64
+	children      map[string]*memNode
+	expire        *time.Timer
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		root:     &memNode{key: "/", dir: true, children: make(map[string]*memNode)},
+		watchers: make(map[*memWatcher]struct{}),
+	}
+}
+
+//已执行的操作次数, 用于压测统计
+func (self *MemoryBackend) Ops() uint64 {
+	return atomic.LoadUint64(&self.ops)
+}
+
+func (self *MemoryBackend) count() {
+	atomic.AddUint64(&self.ops, 1)
+}
+
+func splitKey(key string) []string {
+	parts := make([]string, 0)
+	for _, p := range strings.Split(key, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func memError(code int, key string, index uint64) error {
+	msg := "Key not found"
+	switch code {
+	case client.ErrorCodeNotFile:
+		msg = "Not a file"
+	case client.ErrorCodeNotDir:
+		msg = "Not a directory"
+	case client.ErrorCodeNodeExist:
+		msg = "Key already exists"
+	case client.ErrorCodeEventIndexCleared:
+		msg = "The event in requested index is outdated and cleared"
+	}
+	return client.Error{Code: code, Message: msg, Cause: key, Index: index}
+}
+
+func (self *MemoryBackend) lookup(key string) *memNode {
+	n := self.root
+	for _, p := range splitKey(key) {
+		if !n.dir {
+			return nil
+		}
+		child, ok := n.children[p]
+		if !ok {
+			return nil
+		}
+		n = child
+	}
+	return n
+}
+
+//逐级创建目录, 返回最后一级目录
+func (self *MemoryBackend) mkdirs(parts []string) (*memNode, error) {
+	n := self.root
+	for _, p := range parts {
+		child, ok := n.children[p]
+		if !ok {
+			self.index++
+			child = &memNode{
+				key:           strings.TrimSuffix(n.key, "/") + "/" + p,
+				dir:           true,
+				createdIndex:  self.index,
+				modifiedIndex: self.index,
+				children:      make(map[string]*memNode),
+			}
+			n.children[p] = child
+		} else if !child.dir {
+			return nil, memError(client.ErrorCodeNotDir, child.key, self.index)
+		}
+		n = child
+	}
+	return n, nil
+}
+
+func (n *memNode) toNode(recursive bool) *client.Node {
+	node := &client.Node{
+		Key:           n.key,
+		Dir:           n.dir,
+		Value:         n.value,
+		CreatedIndex:  n.createdIndex,
+		ModifiedIndex: n.modifiedIndex,
+	}
+	if n.dir {
+		names := make([]string, 0, len(n.children))
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := n.children[name]
+			if recursive {
+				node.Nodes = append(node.Nodes, child.toNode(true))
+			} else {
+				node.Nodes = append(node.Nodes, &client.Node{Key: child.key, Dir: child.dir, Value: child.value,
+					CreatedIndex: child.createdIndex, ModifiedIndex: child.modifiedIndex})
+			}
+		}
+	}
+	return node
+}
+
+//通知所有监听了该路径的watcher
+func (self *MemoryBackend) notify(action string, node, prevNode *client.Node) {
+	resp := &client.Response{Action: action, Node: node, PrevNode: prevNode, Index: self.index}
+	for w := range self.watchers {
+		if node.Key != w.dir && !strings.HasPrefix(node.Key, w.dir+"/") {
+			continue
+		}
+		if !w.push(resp) {
+			delete(self.watchers, w)
+		}
+	}
+}
+
+func (self *MemoryBackend) Get(key string) (string, error) {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(key)
+	if n == nil {
+		return "", memError(client.ErrorCodeKeyNotFound, key, self.index)
+	}
+	return n.value, nil
+}
+
+func (self *MemoryBackend) Set(key, value string) error {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err := self.set(key, value)
+	return err
+}
+
+func (self *MemoryBackend) set(key, value string) (*memNode, error) {
+	parts := splitKey(key)
+	if len(parts) == 0 {
+		return nil, memError(client.ErrorCodeNotFile, key, self.index)
+	}
+	parent, err := self.mkdirs(parts[:len(parts)-1])
+	if err != nil {
+		return nil, err
+	}
+	name := parts[len(parts)-1]
+	self.index++
+	var prevNode *client.Node
+	n, ok := parent.children[name]
+	if ok {
+		if n.dir {
+			return nil, memError(client.ErrorCodeNotFile, n.key, self.index)
+		}
+		prevNode = n.toNode(false)
+		if n.expire != nil {
+			n.expire.Stop()
+			n.expire = nil
+		}
+		n.value = value
+		n.modifiedIndex = self.index
+	} else {
+		n = &memNode{
+			key:           strings.TrimSuffix(parent.key, "/") + "/" + name,
+			value:         value,
+			createdIndex:  self.index,
+			modifiedIndex: self.index,
+		}
+		parent.children[name] = n
+	}
+	self.notify("set", n.toNode(false), prevNode)
+	return n, nil
+}
+
+//写入带过期时间的值, 过期后产生expire事件
+func (self *MemoryBackend) SetTtl(key string, value string, ttl time.Duration) error {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n, err := self.set(key, value)
+	if err != nil {
+		return err
+	}
+	//每个节点只保留一个过期定时器, 重新写入时取消旧的定时器
+	modified := n.modifiedIndex
+	n.expire = time.AfterFunc(ttl, func() {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if cur := self.lookup(key); cur == n && cur.modifiedIndex == modified {
+			self.remove(key, "expire")
+		}
+	})
+	return nil
+}
+
+//停止节点及其所有子节点的过期定时器, 与etcd一样递归删除目录只产生一个事件
+func (n *memNode) stopExpire() {
+	if n.expire != nil {
+		n.expire.Stop()
+		n.expire = nil
+	}
+	for _, child := range n.children {
+		child.stopExpire()
+	}
+}
+
+func (self *MemoryBackend) remove(key string, action string) {
+	parts := splitKey(key)
+	parent := self.lookup("/" + strings.Join(parts[:len(parts)-1], "/"))
+	name := parts[len(parts)-1]
+	n := parent.children[name]
+	n.stopExpire()
+	delete(parent.children, name)
+	self.index++
+	prevNode := n.toNode(false)
+	node := &client.Node{Key: n.key, Dir: n.dir, CreatedIndex: n.createdIndex, ModifiedIndex: self.index}
+	self.notify(action, node, prevNode)
+}
+
+func (self *MemoryBackend) Delete(key string) error {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(key)
+	if n == nil || n == self.root {
+		return memError(client.ErrorCodeKeyNotFound, key, self.index)
+	}
+	if n.dir {
+		return memError(client.ErrorCodeNotFile, key, self.index)
+	}
+	self.remove(key, "delete")
+	return nil
+}
+
+func (self *MemoryBackend) DeleteDir(dir string) error {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(dir)
+	if n == nil || n == self.root {
+		return memError(client.ErrorCodeKeyNotFound, dir, self.index)
+	}
+	if !n.dir {
+		return memError(client.ErrorCodeNotDir, dir, self.index)
+	}
+	self.remove(dir, "delete")
+	return nil
+}
+
+func (self *MemoryBackend) CreateDir(dir string) error {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if n := self.lookup(dir); n != nil {
+		return memError(client.ErrorCodeNodeExist, dir, self.index)
+	}
+	n, err := self.mkdirs(splitKey(dir))
+	if err != nil {
+		return err
+	}
+	self.notify("set", n.toNode(false), nil)
+	return nil
+}
+
+func (self *MemoryBackend) IsDirExist(dir string) bool {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(dir)
+	return n != nil && n.dir
+}
+
+func (self *MemoryBackend) IsFileExist(file string) bool {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lookup(file) != nil
+}
+
+func (self *MemoryBackend) GetTree(key string) (*client.Node, error) {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(key)
+	if n == nil {
+		return nil, memError(client.ErrorCodeKeyNotFound, key, self.index)
+	}
+	return n.toNode(true), nil
+}
+
+func (self *MemoryBackend) children(key string, dir bool) ([]string, error) {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	n := self.lookup(key)
+	if n == nil {
+		return nil, memError(client.ErrorCodeKeyNotFound, key, self.index)
+	}
+	children := make([]string, 0)
+	for _, child := range n.children {
+		if child.dir == dir {
+			children = append(children, child.key)
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+func (self *MemoryBackend) GetDirChildren(key string) ([]string, error) {
+	return self.children(key, true)
+}
+
+func (self *MemoryBackend) GetFileChildren(key string) ([]string, error) {
+	return self.children(key, false)
+}
+
+//进程内的watcher从创建时开始接收事件, 与etcd的AfterIndex语义一致
+func (self *MemoryBackend) CreateWatcher(dir string) (client.Watcher, error) {
+	return self.CreateDirWatcher(dir)
+}
+
+func (self *MemoryBackend) CreateDirWatcher(dir string) (client.Watcher, error) {
+	self.count()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.lookup(dir) == nil {
+		return nil, memError(client.ErrorCodeKeyNotFound, dir, self.index)
+	}
+	w := &memWatcher{
+		backend: self,
+		dir:     "/" + strings.Join(splitKey(dir), "/"),
+		notify:  make(chan struct{}, 1),
+	}
+	self.watchers[w] = struct{}{}
+	return w, nil
+}
+
+func (self *MemoryBackend) AutoSync(ctx context.Context, interval time.Duration) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+//进程内watcher, ctx结束或者调用Close后不再接收事件
+type memWatcher struct {
+	backend *MemoryBackend
+	dir     string
+	lock    sync.Mutex
+	events  []*client.Response
+	cleared bool
+	index   uint64
+	notify  chan struct{}
+}
+
+//追加事件, 缓存溢出时返回false, 之后的Next都会返回 EventIndexCleared
+func (w *memWatcher) push(resp *client.Response) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.events) >= MEMORY_WATCH_BUFFER {
+		w.cleared = true
+		w.events = nil
+		w.index = resp.Index
+	} else {
+		w.events = append(w.events, resp)
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+	return !w.cleared
+}
+
+func (w *memWatcher) Next(ctx context.Context) (*client.Response, error) {
+	for {
+		w.lock.Lock()
+		if w.cleared {
+			w.lock.Unlock()
+			return nil, memError(client.ErrorCodeEventIndexCleared, w.dir, w.index)
+		}
+		if len(w.events) > 0 {
+			resp := w.events[0]
+			w.events[0] = nil
+			w.events = w.events[1:]
+			w.lock.Unlock()
+			return resp, nil
+		}
+		w.lock.Unlock()
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			w.Close()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+//从后端移除watcher, 可以重复调用
+func (w *memWatcher) Close() {
+	w.backend.lock.Lock()
+	defer w.backend.lock.Unlock()
+	delete(w.backend.watchers, w)
+}
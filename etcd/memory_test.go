@@ -0,0 +1,97 @@
+package etcd
+
+import (
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func watcherCount(backend *MemoryBackend) int {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	return len(backend.watchers)
+}
+
+//ctx结束或者被替换的watcher从后端移除, 不再接收事件
+func TestMemoryWatcherRemoved(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.CreateDir("/hasky")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, _ := backend.CreateWatcher("/hasky")
+	done := make(chan error)
+	go func() {
+		_, err := w.Next(ctx)
+		done <- err
+	}()
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("next returned %v, want context canceled", err)
+	}
+	if n := watcherCount(backend); n != 0 {
+		t.Fatalf("%d watchers left after cancel", n)
+	}
+
+	replaced, _ := backend.CreateWatcher("/hasky")
+	closeWatcher(replaced)
+	closeWatcher(replaced)
+	if n := watcherCount(backend); n != 0 {
+		t.Fatalf("%d watchers left after close", n)
+	}
+}
+
+//注册中心反复重建watcher时, 后端只保留每个命名空间当前的watcher
+func TestRegistryWatchersBounded(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Set("/hasky/agent-groups/g/members/a/heartbeat", testHeartbeat(time.Now()))
+	registry := newTestRegistry(t, backend)
+	registry.Start(context.Background())
+	for i := 0; i < 20; i++ {
+		for n := 0; n < MEMORY_WATCH_BUFFER+1; n++ {
+			backend.Set("/hasky/agent-groups/g/leader", "a")
+		}
+		time.Sleep(10 * time.Millisecond)
+		if n := watcherCount(backend); n > 1 {
+			t.Fatalf("%d watchers registered for one namespace", n)
+		}
+	}
+	registry.Close()
+	if n := watcherCount(backend); n != 0 {
+		t.Fatalf("%d watchers left after close", n)
+	}
+}
+
+//与etcd v2一致: 已存在的目录返回NodeExist, 递归删除只产生一个事件并停止子节点的过期定时器
+func TestMemoryDirSemantics(t *testing.T) {
+	backend := NewMemoryBackend()
+	if err := backend.CreateDir("/hasky/g/members"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.CreateDir("/hasky/g/members"); !isNodeExist(err) {
+		t.Fatalf("create existing dir returned %v, want node exist", err)
+	}
+
+	backend.SetTtl("/hasky/g/members/a/heartbeat", "agent-hb-1", time.Hour)
+	backend.lock.Lock()
+	child := backend.lookup("/hasky/g/members/a/heartbeat")
+	backend.lock.Unlock()
+
+	w, _ := backend.CreateWatcher("/hasky")
+	if err := backend.DeleteDir("/hasky/g"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp, err := w.Next(ctx)
+	if err != nil || resp.Action != "delete" || resp.Node.Key != "/hasky/g" {
+		t.Fatalf("first event = %+v, %v", resp, err)
+	}
+	if resp, err := w.Next(ctx); err == nil {
+		t.Fatalf("unexpected event %s %s", resp.Action, resp.Node.Key)
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	if child.expire != nil {
+		t.Fatal("ttl timer of a deleted child still armed")
+	}
+}
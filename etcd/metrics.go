@@ -0,0 +1,58 @@
+package etcd
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//运行指标, 计数器与瞬时值统一用int64保存
+type Metrics struct {
+	lock   sync.RWMutex
+	values map[string]*int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{values: make(map[string]*int64)}
+}
+
+func (m *Metrics) value(name string) *int64 {
+	m.lock.RLock()
+	v, ok := m.values[name]
+	m.lock.RUnlock()
+	if ok {
+		return v
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if v, ok = m.values[name]; !ok {
+		v = new(int64)
+		m.values[name] = v
+	}
+	return v
+}
+
+//计数器累加
+func (m *Metrics) Incr(name string, delta int64) {
+	atomic.AddInt64(m.value(name), delta)
+}
+
+//设置瞬时值
+func (m *Metrics) Set(name string, v int64) {
+	atomic.StoreInt64(m.value(name), v)
+}
+
+func (m *Metrics) Get(name string) int64 {
+	return atomic.LoadInt64(m.value(name))
+}
+
+//所有指标的副本
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	snapshot := make(map[string]int64, len(m.values))
+	for name, v := range m.values {
+		snapshot[name] = atomic.LoadInt64(v)
+	}
+	return snapshot
+}
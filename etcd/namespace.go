@@ -0,0 +1,120 @@
+package etcd
+
+import (
+	"fmt"
+	"strings"
+)
+
+//命名空间: 组位于 <prefix>/<namespace>/<group>, hasky写入的其他key也都位于prefix之下
+//第一个命名空间为默认命名空间, 其中的组名不带命名空间, 其余命名空间的组名为 <namespace>/<group>
+type Namespaces struct {
+	prefix string
+	names  []string
+}
+
+//默认的命名空间, 即 /hasky/agent-groups
+func DefaultNamespaces() *Namespaces {
+	return &Namespaces{prefix: DEFAULT_ETCD_PREFIX, names: []string{DEFAULT_NAMESPACE}}
+}
+
+//创建命名空间, prefix为空时使用默认前缀, names为空时使用默认命名空间
+func NewNamespaces(prefix string, names []string) (*Namespaces, error) {
+	if prefix == "" {
+		prefix = DEFAULT_ETCD_PREFIX
+	}
+	if !strings.HasPrefix(prefix, "/") || prefix == "/" {
+		return nil, fmt.Errorf("invalid etcd prefix %q, must be an absolute path", prefix)
+	}
+	n := &Namespaces{prefix: strings.TrimSuffix(prefix, "/")}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid namespace %q, must not contain '/'", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate namespace %s", name)
+		}
+		seen[name] = true
+		n.names = append(n.names, name)
+	}
+	if len(n.names) == 0 {
+		n.names = []string{DEFAULT_NAMESPACE}
+	}
+	return n, nil
+}
+
+func (n *Namespaces) Prefix() string {
+	return n.prefix
+}
+
+//所有命名空间的目录, 第一个为默认命名空间
+func (n *Namespaces) Dirs() []string {
+	dirs := make([]string, len(n.names))
+	for i, name := range n.names {
+		dirs[i] = n.prefix + "/" + name
+	}
+	return dirs
+}
+
+//prefix之下的key, 已经是绝对路径时原样返回
+func (n *Namespaces) Key(key string) string {
+	if strings.HasPrefix(key, "/") {
+		return key
+	}
+	return n.prefix + "/" + key
+}
+
+//key所属的命名空间目录, 不属于任何命名空间时返回空
+func (n *Namespaces) dirOf(key string) string {
+	for _, dir := range n.Dirs() {
+		if strings.HasPrefix(key, dir+"/") {
+			return dir
+		}
+	}
+	return ""
+}
+
+//组的完整路径, 允许传入组名或完整路径
+func (n *Namespaces) GroupPath(name string) string {
+	if n.dirOf(name) != "" {
+		return name
+	}
+	name = strings.Trim(name, "/")
+	if strings.Contains(name, "/") {
+		return n.prefix + "/" + name
+	}
+	return n.prefix + "/" + n.names[0] + "/" + name
+}
+
+//组名或成员名作为key的一级, 不能包含"/"或"..": etcd客户端会清理key, 否则可以写到其他组之下
+func CheckName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid name %q, must not contain '/' or '..'", name)
+	}
+	return nil
+}
+
+//组必须位于某个命名空间之下, 组名本身只有一级
+func (n *Namespaces) CheckGroup(name string) error {
+	path := n.GroupPath(name)
+	dir := n.dirOf(path)
+	if dir == "" {
+		return fmt.Errorf("group %s is not in any namespace", name)
+	}
+	if err := CheckName(strings.TrimPrefix(path, dir+"/")); err != nil {
+		return fmt.Errorf("invalid group %q", name)
+	}
+	return nil
+}
+
+//组的短名称, 默认命名空间之外的组带有命名空间
+func (n *Namespaces) GroupName(path string) string {
+	if dir := n.prefix + "/" + n.names[0] + "/"; strings.HasPrefix(path, dir) {
+		return strings.TrimPrefix(path, dir)
+	}
+	return strings.TrimPrefix(path, n.prefix+"/")
+}
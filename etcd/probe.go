@@ -0,0 +1,164 @@
+package etcd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	//探针类型
+	PROBE_TCP  = "tcp"
+	PROBE_HTTP = "http"
+	PROBE_EXEC = "exec"
+
+	DEFAULT_PROBE_TIMEOUT = 2 * time.Second
+)
+
+//组策略, 存放在 <group>/policy
+type GroupPolicy struct {
+	Probes []*ProbeConfig `json:"probes,omitempty"`
+}
+
+//主动探针配置
+type ProbeConfig struct {
+	Type         string   `json:"type"`
+	Port         int      `json:"port,omitempty"`
+	Path         string   `json:"path,omitempty"`
+	Scheme       string   `json:"scheme,omitempty"`
+	ExpectStatus int      `json:"expect_status,omitempty"`
+	Command      []string `json:"command,omitempty"`
+	Timeout      string   `json:"timeout,omitempty"`
+}
+
+//解析组策略
+func ParseGroupPolicy(value string) (*GroupPolicy, error) {
+	policy := &GroupPolicy{}
+	if value == "" {
+		return policy, nil
+	}
+	if err := json.Unmarshal([]byte(value), policy); err != nil {
+		return nil, err
+	}
+	for _, p := range policy.Probes {
+		if err := p.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return policy, nil
+}
+
+func (p *ProbeConfig) validate() error {
+	switch p.Type {
+	case PROBE_TCP, PROBE_HTTP:
+	case PROBE_EXEC:
+		if len(p.Command) == 0 {
+			return errors.New("exec probe requires a command")
+		}
+	default:
+		return fmt.Errorf("unknown probe type: %s", p.Type)
+	}
+	if p.Timeout != "" {
+		if _, err := time.ParseDuration(p.Timeout); err != nil {
+			return fmt.Errorf("invalid probe timeout %s: %v", p.Timeout, err)
+		}
+	}
+	return nil
+}
+
+func (p *ProbeConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DEFAULT_PROBE_TIMEOUT
+}
+
+//拼接探测地址, 配置了端口时替换成员地址中的端口
+func (p *ProbeConfig) hostPort(address string) string {
+	if p.Port <= 0 {
+		return address
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.Port))
+}
+
+//对成员地址执行探测, 返回nil表示健康
+func (p *ProbeConfig) Run(group, member, address string) error {
+	timeout := p.timeout()
+	switch p.Type {
+	case PROBE_TCP:
+		conn, err := net.DialTimeout("tcp", p.hostPort(address), timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	case PROBE_HTTP:
+		scheme := p.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		url := fmt.Sprintf("%s://%s%s", scheme, p.hostPort(address), p.Path)
+		httpClient := &http.Client{Timeout: timeout}
+		resp, err := httpClient.Get(url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		expect := p.ExpectStatus
+		if expect == 0 {
+			expect = http.StatusOK
+		}
+		if resp.StatusCode != expect {
+			return fmt.Errorf("http probe %s got status %d, expect %d", url, resp.StatusCode, expect)
+		}
+		return nil
+	case PROBE_EXEC:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+		cmd.Env = append(os.Environ(),
+			"HASKY_GROUP="+group,
+			"HASKY_MEMBER="+member,
+			"HASKY_ADDRESS="+address)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("exec probe failed: %v %s", err, out)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown probe type: %s", p.Type)
+}
+
+//去掉策略中的exec探针, 返回新的策略与去掉的个数
+func (self *GroupPolicy) withoutExec() (*GroupPolicy, int) {
+	policy := &GroupPolicy{}
+	for _, p := range self.Probes {
+		if p.Type != PROBE_EXEC {
+			policy.Probes = append(policy.Probes, p)
+		}
+	}
+	return policy, len(self.Probes) - len(policy.Probes)
+}
+
+//执行组内所有探针, 任意一个失败即视为不健康
+func (self *GroupPolicy) Probe(group, member, address string) error {
+	if self == nil {
+		return nil
+	}
+	for _, p := range self.Probes {
+		if err := p.Run(group, member, address); err != nil {
+			return fmt.Errorf("[%s] probe %s: %v", p.Type, address, err)
+		}
+	}
+	return nil
+}
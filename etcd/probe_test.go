@@ -0,0 +1,39 @@
+package etcd
+
+import (
+	"testing"
+)
+
+const testExecPolicy = `{"probes":[{"type":"tcp","port":8080},{"type":"exec","command":["/bin/false"]}]}`
+
+func probeTypes(policy *GroupPolicy) []string {
+	types := make([]string, 0)
+	for _, p := range policy.Probes {
+		types = append(types, p.Type)
+	}
+	return types
+}
+
+//etcd中策略的exec探针只在本机开启 exec-probes 时执行
+func TestExecProbesDisabled(t *testing.T) {
+	backend := NewMemoryBackend()
+	registry := newTestRegistry(t, backend)
+	group := registry.Namespaces().Dirs()[0] + "/group"
+	backend.Set(group+"/policy", testExecPolicy)
+	worker := NewLeaderWorker(registry, registry.Config().HeartbeatInterval, group)
+
+	worker.LoadPolicy()
+	if types := probeTypes(worker.getPolicy()); len(types) != 1 || types[0] != PROBE_TCP {
+		t.Fatalf("probes = %v, exec probe loaded while disabled", types)
+	}
+
+	cfg := *registry.Config()
+	cfg.ExecProbes = true
+	if err := registry.UpdateConfig(&cfg); err != nil {
+		t.Fatal(err)
+	}
+	worker.LoadPolicy()
+	if types := probeTypes(worker.getPolicy()); len(types) != 2 {
+		t.Fatalf("probes = %v, exec probe not loaded while enabled", types)
+	}
+}
@@ -1,10 +1,15 @@
 package etcd
 
 import (
-	log "github.com/alecthomas/log4go"
+	"errors"
+	"fmt"
+	"github.com/coreos/etcd/client"
+	"github.com/domac/hasky/logger"
 	"golang.org/x/net/context"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,128 +18,428 @@ type Exchange struct {
 	To          string
 	WorkerGroup string
 	OpEvent     OperationEvent
+	Manual      bool //管理员发起的切换, 不计入抖动统计
 }
 
 //Etcd服务注册
 type EtcdRegistry struct {
 	lock            sync.RWMutex
-	registryClient  *Client
+	registryClient  Backend
 	registryContext context.Context
 	workers         map[string]*LeaderWorker
-	exchangeChan    chan *Exchange
-	isClosed        bool
+	scheduler       *scheduler
+	guard           *failoverGuard
+	checkQueue      chan *LeaderWorker
+	namespaces      *Namespaces
+	config          atomic.Value //*Config, 运行中可通过 UpdateConfig 替换
+	metrics         *Metrics
+	events          *EventLog
+	declared        map[string]*GroupDefinition //声明的组, key为组的完整路径
+	missingReported map[string]string           //已经告警的缺失成员, 变化时才再次告警
+	logger          *logger.Logger              //根日志器, 各组件由此派生
+	log             *logger.Logger
+	cancel          context.CancelFunc
+	waitGroup       sync.WaitGroup
 }
 
-func NewEtcdRegistry(hosts string) *EtcdRegistry {
-	log.Info("etcd host info: %s \n", hosts)
-	etcdAddress := strings.Split(hosts, ",")
-	Init(etcdAddress)
-	cli := GetClient()
-	ctx := GetContext()
+//连接etcd并创建注册中心, 证书或者认证错误时返回错误
+func NewEtcdRegistry(cfg *ClientConfig) (*EtcdRegistry, error) {
+	if err := Init(cfg); err != nil {
+		return nil, err
+	}
+	registry := NewEtcdRegistryWithBackend(GetClient())
+	registry.SetNamespaces(cfg.Namespaces)
+	registry.SetLogger(cfg.Logger)
+	return registry, nil
+}
 
-	return &EtcdRegistry{
-		registryClient:  cli,
-		registryContext: ctx,
+//使用指定的存储后端创建注册中心
+func NewEtcdRegistryWithBackend(backend Backend) *EtcdRegistry {
+	registry := &EtcdRegistry{
+		registryClient:  backend,
+		registryContext: context.Background(),
 		workers:         make(map[string]*LeaderWorker, 5),
-		exchangeChan:    make(chan *Exchange, 4096),
-		isClosed:        false}
+		checkQueue:      make(chan *LeaderWorker, 4096),
+		namespaces:      DefaultNamespaces(),
+		metrics:         NewMetrics(),
+		events:          NewEventLog(),
+		declared:        make(map[string]*GroupDefinition),
+		missingReported: make(map[string]string),
+		guard:           newFailoverGuard()}
+	registry.config.Store(DefaultConfig())
+	registry.scheduler = newScheduler(SCHEDULER_WORKERS, SCHEDULER_QUEUE_LIMIT, registry.metrics, registry.handleExchange)
+	registry.SetLogger(logger.Default())
+	return registry
+}
+
+//设置日志器, 需在Start之前调用; 注册中心、worker、调度等组件的日志由其派生
+func (self *EtcdRegistry) SetLogger(l *logger.Logger) {
+	self.logger = l
+	self.log = l.Named("registry")
+	self.scheduler.log = l.Named("scheduler")
+}
+
+//设置组所在的命名空间, 需在Start之前调用
+func (self *EtcdRegistry) SetNamespaces(namespaces *Namespaces) {
+	self.namespaces = namespaces
+	self.events.setNamespaces(namespaces)
+}
+
+func (self *EtcdRegistry) Namespaces() *Namespaces {
+	return self.namespaces
+}
+
+func (self *EtcdRegistry) Metrics() *Metrics {
+	return self.metrics
 }
 
-//启动服务注册中心
-func (self *EtcdRegistry) Start() {
+func (self *EtcdRegistry) Events() *EventLog {
+	return self.events
+}
+
+//在注册中心的等待组中运行, Close时等待其结束
+func (self *EtcdRegistry) wrap(f func()) {
+	self.waitGroup.Add(1)
+	go func() {
+		defer self.waitGroup.Done()
+		f()
+	}()
+}
+
+//启动服务注册中心, ctx结束或调用Close后所有后台任务退出
+func (self *EtcdRegistry) Start(ctx context.Context) {
+	ctx, self.cancel = context.WithCancel(ctx)
+	self.registryContext = ctx
+
 	//同步心跳
-	go self.heartbeat()
+	self.wrap(func() { self.heartbeat(ctx) })
 
-	//检查故障
-	go self.checkAlive()
+	//检查故障, 并发数固定, 不随组的数量增长
+	for i := 0; i < self.Config().CheckConcurrency; i++ {
+		self.wrap(func() { self.checkAlive(ctx) })
+	}
 
-	//服务发现
-	go self.discovery()
+	//服务发现, 每个命名空间一个watcher
+	for _, dir := range self.namespaces.Dirs() {
+		dir := dir
+		self.wrap(func() { self.discovery(ctx, dir) })
+	}
 
 	//工作调度
-	go self.schedule()
+	for i := 0; i < self.scheduler.workers; i++ {
+		self.wrap(func() { self.scheduler.run(ctx) })
+	}
+
+	//定期校正内存与etcd的差异
+	self.wrap(func() { self.reconcile(ctx) })
+
+	//检查etcd连接与本机时钟
+	self.wrap(func() { self.watchdog(ctx) })
 }
 
 //服务心跳
-func (self *EtcdRegistry) heartbeat() {
-	for !self.isClosed {
-		err := self.registryClient.client.AutoSync(context.Background(), 10*time.Second)
+func (self *EtcdRegistry) heartbeat(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := self.registryClient.AutoSync(ctx, self.Config().AutoSyncInterval)
 		if err == context.DeadlineExceeded || err == context.Canceled {
 			break
 		}
+		//同步失败时稍后重试
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
 }
 
-//负责检查agent的存活性
-func (self *EtcdRegistry) checkAlive() {
-	for !self.isClosed {
-		for _, w := range self.workers {
-			go w.Keepalive()
+//负责检查agent的存活性, 从检查队列中取出需要检查的worker
+func (self *EtcdRegistry) checkAlive(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case w := <-self.checkQueue:
+			atomic.StoreInt32(&w.queued, 0)
+			self.metrics.Incr("checks.runs", 1)
+			w.Keepalive(ctx)
+			w.reschedule()
 		}
-		time.Sleep(CHECK_ALIVE_INTERVAL)
 	}
 }
 
-//服务发现
-func (self *EtcdRegistry) discovery() {
-	log.Info("service monitor begin")
-	nodeinfo, err := self.registryClient.GetDirChildren(DISCOVERY)
-	if err != nil {
-		log.Error("error to get nodes from %s", DISCOVERY)
+//把worker放入检查队列, 已经在队列中的worker不会重复加入
+func (self *EtcdRegistry) enqueueCheck(w *LeaderWorker) {
+	if !atomic.CompareAndSwapInt32(&w.queued, 0, 1) {
+		return
 	}
+	select {
+	case self.checkQueue <- w:
+	case <-self.registryContext.Done():
+		atomic.StoreInt32(&w.queued, 0)
+	}
+}
 
-	//首次发现系统节点
-	for _, group := range nodeinfo {
-		membersDir := group + "/members"
-		memmbers, err := self.registryClient.GetDirChildren(membersDir)
-		if err != nil || memmbers == nil {
-			log.Error("error to get members from %s", membersDir)
+//提交调度请求, 队列已满时返回false
+func (self *EtcdRegistry) submit(ex *Exchange) bool {
+	return self.scheduler.submit(ex)
+}
+
+//服务发现
+//先建立watcher再全量同步, 保证同步期间的事件不会丢失;
+//watcher的索引过期后重新同步并重建watcher
+func (self *EtcdRegistry) discovery(ctx context.Context, dir string) {
+	self.log.Info("discovery started", "dir", dir)
+	failures := 0
+	for ctx.Err() == nil {
+		discoverWatcher, err := self.registryClient.CreateWatcher(dir)
+		if err == nil {
+			if err = self.resync(dir, "discovery"); err != nil {
+				closeWatcher(discoverWatcher)
+			}
+		}
+		if err != nil {
+			failures++
+			self.log.Error("discovery failed, retry later", "dir", dir, "failures", failures, "error", err)
+			sleepContext(ctx, self.backoffDuration(failures))
 			continue
 		}
+		failures = 0
 
-		log.Info("register a group [%s] to a worker", group)
+		err = self.watch(ctx, dir, discoverWatcher)
+		closeWatcher(discoverWatcher)
+		if isEventIndexCleared(err) {
+			self.log.Warn("watcher index is outdated, resync now", "dir", dir)
+		}
+	}
+}
 
-		if _, ok := self.workers[group]; !ok {
-			self.registWorker(group)
+//消费watcher事件, 直到ctx结束或者watcher索引过期
+func (self *EtcdRegistry) watch(ctx context.Context, dir string, discoverWatcher client.Watcher) error {
+	failures := 0
+	for {
+		resp, err := discoverWatcher.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if isEventIndexCleared(err) {
+				return err
+			}
+			failures++
+			self.guard.failure()
+			self.log.Error("watch failed", "dir", dir, "failures", failures, "error", err)
+			sleepContext(ctx, self.backoffDuration(failures))
+			continue
+		}
+		failures = 0
+		self.guard.contact(time.Now())
+
+		//已有worker的成员事件无需再做注册处理, 避免每次心跳都启动协程
+		if self.routeMemberEvent(resp) {
+			continue
 		}
+		key := resp.Node.Key
+		switch resp.Action {
+		case "create", "set", "update": //新增,修改
+			self.wrap(func() { self.handleCreateEvent(key) })
+		case "delete", "expire", "compareAndDelete": //过期,删除
+			self.wrap(func() { self.handleRemoveEvent(key) })
+		default:
+		}
+	}
+}
+
+//成员事件同步交给所属的worker, 保证同一成员的事件按顺序处理
+//leader的状态发生变化时立即检查, 不等待下一个检查周期; 返回事件是否已被worker处理
+func (self *EtcdRegistry) routeMemberEvent(resp *client.Response) bool {
+	group, member, file := splitMemberKey(resp.Node.Key)
+	if member == "" {
+		return false
+	}
+	w := self.getWorker(group)
+	if w == nil {
+		return false
 	}
+	if w.onMemberEvent(resp.Action, member, file, resp.Node) {
+		self.enqueueCheck(w)
+	}
+	return true
+}
+
+//拆分成员路径: <group>/members/<member>[/<file>]
+func splitMemberKey(key string) (string, string, string) {
+	index := strings.Index(key, "/members/")
+	if index < 0 {
+		return "", "", ""
+	}
+	parts := strings.SplitN(key[index+len("/members/"):], "/", 2)
+	if len(parts) == 1 {
+		return key[:index], parts[0], ""
+	}
+	return key[:index], parts[0], parts[1]
+}
+
+//定期全量校正
+func (self *EtcdRegistry) reconcile(ctx context.Context) {
+	interval := func() time.Duration { return self.Config().ReconcileInterval }
+	TickEvery(ctx, interval, func(time.Duration) {
+		//先恢复被删除的声明组, 再由同步注册worker
+		self.applyDefinitions("reconcile")
+		for _, dir := range self.namespaces.Dirs() {
+			if err := self.resync(dir, "reconcile"); err != nil {
+				self.metrics.Incr("reconcile.errors", 1)
+				self.log.Error("reconcile failed", "dir", dir, "error", err)
+			}
+		}
+		self.checkDeclaredMembers()
+	})
+}
 
-	//监听组目录
-	discoverWatcher, err := self.registryClient.CreateDirWatcher(DISCOVERY)
+//全量同步etcd与内存中命名空间dir下的worker:
+//1. 补充etcd中存在但没有worker的组
+//2. 移除etcd中已经消失的组
+//3. 以etcd为准校正worker的leader, etcd中没有leader时写回内存中的leader
+func (self *EtcdRegistry) resync(dir, reason string) error {
+	root, err := self.registryClient.GetTree(dir)
 	if err != nil {
-		return
+		return err
 	}
-	go func() {
-		for !self.isClosed {
-			resp, err := discoverWatcher.Next(ctx)
-			if err != nil {
-				continue
+	self.metrics.Incr(reason+".runs", 1)
+
+	exists := make(map[string]*client.Node)
+	added, removed, fixed := 0, 0, 0
+	for _, group := range root.Nodes {
+		if !group.Dir || !hasDirChild(group, group.Key+"/members") {
+			continue
+		}
+		exists[group.Key] = group
+		if self.getWorker(group.Key) == nil {
+			self.log.Debug("group found", "group", group.Key, "reason", reason)
+			self.registWorker(group.Key)
+			self.events.Add(EVENT_RECONCILE_ADD, group.Key, "", "%s: group registered", reason)
+			added++
+		}
+	}
+
+	for _, w := range self.workerList() {
+		if self.namespaces.dirOf(w.Group) != dir {
+			continue
+		}
+		group, ok := exists[w.Group]
+		if !ok {
+			if self.unRegistWorker(w.Group) {
+				self.events.Add(EVENT_RECONCILE_REMOVE, w.Group, "", "%s: group vanished", reason)
+				removed++
 			}
-			switch resp.Action {
-			case "create", "update": //新增,修改
-				go self.handleCreateEvent(resp.Node.Key)
-			case "delete": //过期,删除
-				go self.handleRemoveEvent(resp.Node.Key)
-			default:
+			continue
+		}
+
+		//以快照校正成员状态, 补上watch可能遗漏的成员
+		w.lock.Lock()
+		w.observeGroup(group, time.Now())
+		w.lock.Unlock()
+
+		leader := childValue(group, w.Group+"/leader")
+		workingNode := w.getWorkingNode()
+		if leader == workingNode {
+			continue
+		}
+		//快照可能已经过期(例如期间发生了切换), 修正前重新读取一次
+		leader = self.GetGroupLeader(w.Group)
+		workingNode = w.getWorkingNode()
+		switch {
+		case leader != "" && leader != workingNode:
+			w.setWorkingNode(leader)
+			self.events.Add(EVENT_RECONCILE_LEADER, w.Group, leader,
+				"%s: leader drift, memory [%s] etcd [%s]", reason, workingNode, leader)
+			fixed++
+		case leader == "" && workingNode != "":
+			if err := self.SetGroupLeader(w.Group, workingNode); err != nil {
+				self.log.Error("write back leader failed", "group", w.Group, "leader", workingNode, "error", err)
+				continue
 			}
+			self.events.Add(EVENT_RECONCILE_LEADER, w.Group, workingNode,
+				"%s: leader missing in etcd, restored [%s]", reason, workingNode)
+			fixed++
 		}
-	}()
+	}
+
+	self.metrics.Incr(reason+".groups_added", int64(added))
+	self.metrics.Incr(reason+".groups_removed", int64(removed))
+	self.metrics.Incr(reason+".leaders_fixed", int64(fixed))
+	self.metrics.Set("groups", int64(self.workerCount()))
+	if added+removed+fixed > 0 {
+		self.log.Info("groups synced", "reason", reason, "dir", dir,
+			"groups", len(exists), "added", added, "removed", removed, "leaders_fixed", fixed)
+	}
+	return nil
 }
 
-//工作调度
-func (self *EtcdRegistry) schedule() {
-	for !self.isClosed {
-		select {
-		case ex := <-self.exchangeChan:
-			go self.handleExchange(ex)
+func hasDirChild(node *client.Node, key string) bool {
+	for _, n := range node.Nodes {
+		if n.Key == key && n.Dir {
+			return true
+		}
+	}
+	return false
+}
+
+func childValue(node *client.Node, key string) string {
+	for _, n := range node.Nodes {
+		if n.Key == key && !n.Dir {
+			return n.Value
+		}
+	}
+	return ""
+}
+
+func isEventIndexCleared(err error) bool {
+	if e, ok := err.(client.Error); ok {
+		return e.Code == client.ErrorCodeEventIndexCleared
+	}
+	return false
+}
+
+//指数退避的等待时间
+func (self *EtcdRegistry) backoffDuration(failures int) time.Duration {
+	d := self.Config().WatchRetryMin
+	for i := 1; i < failures && d < self.Config().WatchRetryMax; i++ {
+		d *= 2
+	}
+	if d > self.Config().WatchRetryMax {
+		d = self.Config().WatchRetryMax
+	}
+	return d
+}
+
+//按间隔重复执行fn直到ctx结束, 每次等待前调用interval读取间隔, 运行中修改的参数在下一次等待时生效
+//fn的参数为本次等待的间隔
+func TickEvery(ctx context.Context, interval func() time.Duration, fn func(time.Duration)) {
+	for {
+		d := interval()
+		if !sleepContext(ctx, d) {
+			return
 		}
+		fn(d)
+	}
+}
+
+//等待指定时间, ctx结束时提前返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
 
 //根据完整路径获取组与节点名称
 func (self *EtcdRegistry) getGroupAndAgentFromFullPath(dir string) (string, string) {
-	// ===> /hasky/agent-groups/devops-001/members/localhost/heartbeat
-	if strings.Contains(dir, "/hasky/agent-groups/") &&
+	//===> /hasky/agent-groups/devops-001/members/localhost/heartbeat
+	if self.namespaces.dirOf(dir) != "" &&
 		strings.Contains(dir, "/members/") && strings.Contains(dir, "/heartbeat") {
 		newGroupName := dir[:strings.Index(dir, "/members/")]
 		newAgentName := dir[:strings.Index(dir, "/heartbeat")]
@@ -145,6 +450,14 @@ func (self *EtcdRegistry) getGroupAndAgentFromFullPath(dir string) (string, stri
 
 //agent注册处理
 func (self *EtcdRegistry) handleCreateEvent(dir string) {
+	//组策略变更
+	if strings.HasSuffix(dir, "/policy") {
+		if w := self.getWorker(strings.TrimSuffix(dir, "/policy")); w != nil {
+			self.log.Info("reload group policy", "group", w.Group)
+			w.LoadPolicy()
+		}
+		return
+	}
 	group, agent := self.getGroupAndAgentFromFullPath(dir)
 	if group != "" && agent != "" {
 		self.registWorker(group)
@@ -153,66 +466,216 @@ func (self *EtcdRegistry) handleCreateEvent(dir string) {
 
 //元素移除处理
 func (self *EtcdRegistry) handleRemoveEvent(dir string) {
-	log.Info("[DELETE] >> %s", dir)
-
-	if g, ok := self.workers[dir]; ok {
-		log.Info("[DELETE][GROUP] >> %s", g.Group)
-		self.unRegistWorker(dir)
+	self.log.Debug("key deleted", "key", dir)
+
+	//声明的组被删除时, 先记下删除前的leader与成员
+	group := strings.TrimSuffix(dir, "/members")
+	def := self.declaredGroups()[group]
+	var lost *WorkerSnapshot
+	if w := self.getWorker(group); w != nil && def != nil {
+		lost = w.Snapshot()
+	}
+	if self.unRegistWorker(dir) {
+		self.log.Info("group deleted", "group", dir)
+	}
+	if def != nil {
+		self.restoreDeclaredGroup(group, def, lost)
 	}
 }
 
 //注册keepalive worker
 func (self *EtcdRegistry) registWorker(group string) {
-	if _, ok := self.workers[group]; !ok {
-		log.Info("[ADD] REGISTER GROUP WORKER : %s ", group)
-		w := NewLeaderWorker(self, 1*time.Second, group)
-		self.lock.RLock()
-		self.workers[group] = w
-		self.lock.RUnlock()
-		w.StartWorking()
+	self.lock.Lock()
+	if _, ok := self.workers[group]; ok {
+		self.lock.Unlock()
+		return
 	}
+	self.log.Info("group worker registered", "group", group)
+	w := NewLeaderWorker(self, self.Config().HeartbeatInterval, group)
+	self.workers[group] = w
+	self.lock.Unlock()
+
+	w.StartWorking()
+	self.enqueueCheck(w)
 }
 
-//注销 worker
-func (self *EtcdRegistry) unRegistWorker(group string) {
-	if w, ok := self.workers[group]; ok {
+//注销 worker, 返回worker是否存在
+func (self *EtcdRegistry) unRegistWorker(group string) bool {
+	self.lock.Lock()
+	w, ok := self.workers[group]
+	delete(self.workers, group)
+	self.lock.Unlock()
+
+	if ok {
 		w.StopWorking()
-		log.Info("[REMOVE] UN-REGISTER GROUP >> %s", group)
-		self.lock.RLock()
-		delete(self.workers, group)
-		self.lock.RUnlock()
+		self.log.Info("group worker unregistered", "group", group)
+	}
+	return ok
+}
+
+func (self *EtcdRegistry) getWorker(group string) *LeaderWorker {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.workers[group]
+}
+
+func (self *EtcdRegistry) workerCount() int {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return len(self.workers)
+}
 
+//当前所有worker的列表副本
+func (self *EtcdRegistry) workerList() []*LeaderWorker {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	list := make([]*LeaderWorker, 0, len(self.workers))
+	for _, w := range self.workers {
+		list = append(list, w)
 	}
+	return list
 }
 
-func (self *EtcdRegistry) GetWorkers() map[string]*LeaderWorker {
-	return self.workers
+//返回所有worker的状态快照
+func (self *EtcdRegistry) GetWorkers() map[string]*WorkerSnapshot {
+	snapshots := make(map[string]*WorkerSnapshot)
+	for _, w := range self.workerList() {
+		snapshots[w.Group] = w.Snapshot()
+	}
+	return snapshots
+}
+
+//组与成员的抑制状态, group为空时返回所有组
+func (self *EtcdRegistry) GetDamping(group string) []*DampingStatus {
+	statuses := make([]*DampingStatus, 0)
+	for _, w := range self.workerList() {
+		if group == "" || w.Group == self.namespaces.GroupPath(group) {
+			statuses = append(statuses, w.Damping())
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Group < statuses[j].Group })
+	return statuses
+}
+
+//按组名获取worker的状态快照, 允许传入组名或完整路径
+func (self *EtcdRegistry) GetWorkerSnapshot(group string) *WorkerSnapshot {
+	w := self.getWorker(self.namespaces.GroupPath(group))
+	if w == nil {
+		return nil
+	}
+	return w.Snapshot()
+}
+
+//写入新的leader, 写入失败时worker的状态不变
+//自动切换由worker的下一次检查重新提交, 管理员发起的切换需要重新请求
+func (self *EtcdRegistry) updateGroupLeader(group string, oldNode, newNode string, manual bool) error {
+	if oldNode == newNode {
+		return nil
+	}
+	w := self.getWorker(group)
+	if w == nil {
+		return nil
+	}
+	//请求提交后leader已经变化, 丢弃过期的请求
+	if current := w.getWorkingNode(); current != oldNode {
+		self.metrics.Incr("scheduler.stale", 1)
+		self.log.Info("drop stale exchange", "group", group, "from", oldNode, "to", newNode, "leader", current)
+		return nil
+	}
+	if err := self.SetGroupLeader(group, newNode); err != nil {
+		return fmt.Errorf("set leader of %s to %s failed: %v", group, newNode, err)
+	}
+	w.setWorkingNode(newNode)
+	if manual {
+		self.metrics.Incr("switchovers", 1)
+		self.events.Add(EVENT_SWITCHOVER, group, newNode, "leader switched from [%s] to [%s] by admin", oldNode, newNode)
+		return nil
+	}
+	w.recordFailover(time.Now())
+	self.metrics.Incr("failovers", 1)
+	self.events.Add(EVENT_FAILOVER, group, newNode, "leader changed from [%s] to [%s]", oldNode, newNode)
+	return nil
+}
+
+//管理员指定新的leader, 成员需为healthy状态, force为true时跳过检查
+//与自动切换一样经由调度器执行, 但不受抖动抑制与切换保护的限制
+func (self *EtcdRegistry) PromoteMember(group, member string, force bool) error {
+	w := self.getWorker(self.namespaces.GroupPath(group))
+	if w == nil {
+		return fmt.Errorf("group %s not found", group)
+	}
+	status := w.MemberStatus(member)
+	if status == nil {
+		return fmt.Errorf("member %s not found in %s", member, group)
+	}
+	leader := w.getWorkingNode()
+	if leader == member {
+		return fmt.Errorf("member %s is already the leader of %s", member, group)
+	}
+	if !force && status.State != STATE_HEALTHY {
+		return fmt.Errorf("member %s is %s", member, status.State)
+	}
+	return self.submitSwitchover(w, leader, member)
 }
 
-func (self *EtcdRegistry) updateGroupLeader(group string, oldNode, newNode string) {
-	if oldNode != newNode {
-		self.SetGroupLeader(group, newNode)
+//管理员要求切换leader, 按自动切换的规则选出新的leader
+func (self *EtcdRegistry) SwitchLeader(group string) (string, error) {
+	w := self.getWorker(self.namespaces.GroupPath(group))
+	if w == nil {
+		return "", fmt.Errorf("group %s not found", group)
+	}
+	leader := w.getWorkingNode()
+	member, err := w.findGroupAliveNode(leader)
+	if err != nil {
+		return "", err
+	}
+	return member, self.submitSwitchover(w, leader, member)
+}
 
-		w := self.workers[group]
-		w.WorkingNode = newNode
+func (self *EtcdRegistry) submitSwitchover(w *LeaderWorker, from, to string) error {
+	self.log.Info("switchover requested", "group", w.Group, "from", from, "to", to)
+	if !self.submit(&Exchange{From: from, To: to, WorkerGroup: w.Group, OpEvent: UpdateEvent, Manual: true}) {
+		return errors.New("scheduler queue is full")
 	}
+	return nil
 }
 
-func (self *EtcdRegistry) handleExchange(ex *Exchange) {
+func (self *EtcdRegistry) handleExchange(ex *Exchange) error {
 	switch ex.OpEvent {
 	case UpdateEvent:
-		self.updateGroupLeader(ex.WorkerGroup, ex.From, ex.To)
+		return self.updateGroupLeader(ex.WorkerGroup, ex.From, ex.To, ex.Manual)
 	case ExitEvent:
 		self.unRegistWorker(ex.WorkerGroup)
 	case StopEvent:
 		self.StopLeaderRunning(ex.WorkerGroup)
 	}
+	return nil
 }
 
 //停止当前的leader运行
 func (self *EtcdRegistry) StopLeaderRunning(group string) {
 	leader := self.GetGroupLeader(group)
-	log.Info("STOP LEADER RUNNING : %s", leader)
+	self.log.Info("stop leader running", "group", group, "leader", leader)
+}
+
+//读取etcd中的配置项, 如API令牌
+func (self *EtcdRegistry) GetValue(key string) (string, error) {
+	return self.registryClient.Get(key)
+}
+
+//导出prefix下所有key的快照, heartbeats为false时不包含心跳, secrets为false时不包含令牌
+func (self *EtcdRegistry) ExportSnapshot(heartbeats, secrets bool) (*Snapshot, error) {
+	return ExportSnapshot(self.registryClient, self.namespaces.Prefix(), heartbeats, secrets)
+}
+
+//导入快照, 写入的key由watch同步到各组
+func (self *EtcdRegistry) ImportSnapshot(snap *Snapshot, conflict ConflictPolicy, dryRun bool) (*ImportResult, error) {
+	result, err := ImportSnapshot(self.registryClient, self.namespaces.Prefix(), snap, conflict, dryRun)
+	if err == nil && !dryRun {
+		self.log.Info("snapshot imported", "created", result.Created, "updated", result.Updated, "skipped", result.Skipped)
+		self.metrics.Incr("snapshot.imports", 1)
+	}
+	return result, err
 }
 
 //获取组leader名称
@@ -225,12 +688,27 @@ func (self *EtcdRegistry) GetGroupLeader(group string) string {
 	return leader
 }
 
+//获取组策略, 未配置时返回空策略
+func (self *EtcdRegistry) GetGroupPolicy(group string) (*GroupPolicy, error) {
+	value, err := self.registryClient.Get(group + "/policy")
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return self.Config().DefaultPolicy, nil
+		}
+		return nil, err
+	}
+	return ParseGroupPolicy(value)
+}
+
 func (self *EtcdRegistry) SetGroupLeader(group string, leader string) error {
 	leaderFile := group + "/leader"
 	return self.registryClient.Set(leaderFile, leader)
 }
 
-//注册服务关闭
+//注册服务关闭, 等待所有后台任务退出
 func (self *EtcdRegistry) Close() {
-	self.isClosed = true
+	if self.cancel != nil {
+		self.cancel()
+	}
+	self.waitGroup.Wait()
 }
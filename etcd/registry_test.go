@@ -0,0 +1,168 @@
+package etcd
+
+import (
+	"fmt"
+	"github.com/domac/hasky/logger"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	churnGroups   = 20
+	churnMembers  = 4
+	churnDuration = 2 * time.Second
+)
+
+func testHeartbeat(now time.Time) string {
+	return fmt.Sprintf("agent-hb-%d", now.Unix())
+}
+
+//使用内存后端与较短的心跳间隔创建注册中心
+func newTestRegistry(t *testing.T, backend Backend) *EtcdRegistry {
+	registry := NewEtcdRegistryWithBackend(backend)
+	registry.SetLogger(logger.New(ioutil.Discard, logger.FORMAT_LOGFMT))
+	cfg := DefaultConfig()
+	cfg.HeartbeatInterval = 10 * time.Millisecond
+	cfg.CheckInterval = 20 * time.Millisecond
+	cfg.ReconcileInterval = 100 * time.Millisecond
+	if err := registry.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+//etcd中存在成员目录的组
+func backendGroups(t *testing.T, backend Backend, dir string) []string {
+	root, err := backend.GetTree(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make([]string, 0)
+	for _, group := range root.Nodes {
+		if group.Dir && hasDirChild(group, group.Key+"/members") {
+			groups = append(groups, group.Key)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func workerGroups(registry *EtcdRegistry) []string {
+	groups := make([]string, 0)
+	for group := range registry.GetWorkers() {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+//成员不断加入、离开、写入心跳, 组被删除与重建, 同时并发读取worker与成员
+//结束后worker必须与etcd中的组一致, 需要配合 go test -race 运行
+func TestRegistryChurn(t *testing.T) {
+	backend := NewMemoryBackend()
+	registry := newTestRegistry(t, backend)
+	dir := registry.Namespaces().Dirs()[0]
+	groupPath := func(g int) string { return fmt.Sprintf("%s/group-%02d", dir, g) }
+	memberPath := func(g, m int) string { return fmt.Sprintf("%s/members/agent-%d", groupPath(g), m) }
+	for g := 0; g < churnGroups; g++ {
+		for m := 0; m < churnMembers; m++ {
+			backend.Set(memberPath(g, m)+"/heartbeat", testHeartbeat(time.Now()))
+		}
+		backend.Set(groupPath(g)+"/leader", "agent-0")
+	}
+
+	registry.Start(context.Background())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	running := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f()
+			}
+		}()
+	}
+
+	//写入: 心跳、成员加入与离开、组删除
+	for i := 0; i < 4; i++ {
+		r := rand.New(rand.NewSource(int64(i)))
+		running(func() {
+			g, m := r.Intn(churnGroups), r.Intn(churnMembers)
+			switch n := r.Intn(20); {
+			case n < 12:
+				backend.Set(memberPath(g, m)+"/heartbeat", testHeartbeat(time.Now()))
+			case n < 15:
+				backend.SetTtl(memberPath(g, m)+"/heartbeat", testHeartbeat(time.Now()), 50*time.Millisecond)
+			case n < 18:
+				backend.DeleteDir(memberPath(g, m))
+			case n < 19:
+				backend.Set(groupPath(g)+"/leader", fmt.Sprintf("agent-%d", m))
+			default:
+				backend.DeleteDir(groupPath(g))
+			}
+			time.Sleep(time.Millisecond)
+		})
+	}
+
+	//读取: worker快照、成员查询与状态接口
+	for i := 0; i < 4; i++ {
+		r := rand.New(rand.NewSource(int64(100 + i)))
+		running(func() {
+			g := r.Intn(churnGroups)
+			for group, snapshot := range registry.GetWorkers() {
+				if snapshot.Group != group {
+					t.Errorf("snapshot of %s reports group %s", group, snapshot.Group)
+				}
+			}
+			if _, err := registry.QueryMembers(&MemberQuery{}); err != nil {
+				t.Errorf("query members failed: %v", err)
+			}
+			registry.QueryMembers(&MemberQuery{Group: groupPath(g), Health: "healthy"})
+			registry.GetWorkerSnapshot(groupPath(g))
+			registry.GetDamping("")
+			registry.GuardStatus()
+			registry.Events().List(0, "", 10)
+			registry.Metrics().Snapshot()
+			time.Sleep(time.Millisecond)
+		})
+	}
+
+	time.Sleep(churnDuration)
+	close(stop)
+	wg.Wait()
+
+	//停止写入后, 由watch与定期校正收敛到etcd中的组
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		want, got := backendGroups(t, backend, dir), workerGroups(registry)
+		if fmt.Sprint(want) == fmt.Sprint(got) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("workers did not converge\netcd:    %v\nworkers: %v", want, got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		registry.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry did not close")
+	}
+}
@@ -0,0 +1,156 @@
+package etcd
+
+import (
+	"github.com/domac/hasky/logger"
+	"golang.org/x/net/context"
+	"sync"
+)
+
+//调度器: 同一个组的请求按提交顺序串行执行, 不同组之间由固定数量的协程并行执行
+//排队中的重复请求会被合并, 排队总数超过上限时直接丢弃, 提交方不会被阻塞
+type scheduler struct {
+	lock    sync.Mutex
+	groups  map[string]*groupQueue
+	ready   chan string
+	depth   int
+	limit   int
+	workers int
+	metrics *Metrics
+	handle  func(*Exchange) error
+	log     *logger.Logger
+}
+
+//单个组的请求队列
+type groupQueue struct {
+	exchanges []*Exchange
+	queued    bool //组已在ready中等待执行
+	running   bool //组正在被某个协程执行
+}
+
+func newScheduler(workers, limit int, metrics *Metrics, handle func(*Exchange) error) *scheduler {
+	if workers <= 0 {
+		workers = SCHEDULER_WORKERS
+	}
+	if limit <= 0 {
+		limit = SCHEDULER_QUEUE_LIMIT
+	}
+	return &scheduler{
+		groups:  make(map[string]*groupQueue),
+		ready:   make(chan string, limit),
+		limit:   limit,
+		workers: workers,
+		metrics: metrics,
+		handle:  handle,
+	}
+}
+
+//提交请求, 被合并时返回true, 队列已满被丢弃时返回false
+func (s *scheduler) submit(ex *Exchange) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.metrics.Incr("scheduler.submitted", 1)
+
+	q, ok := s.groups[ex.WorkerGroup]
+	if !ok {
+		q = &groupQueue{}
+		s.groups[ex.WorkerGroup] = q
+	}
+	if s.coalesce(q, ex) {
+		s.metrics.Incr("scheduler.merged", 1)
+		return true
+	}
+	if s.depth >= s.limit {
+		if len(q.exchanges) == 0 && !q.running && !q.queued {
+			delete(s.groups, ex.WorkerGroup)
+		}
+		s.metrics.Incr("scheduler.dropped", 1)
+		s.log.Warn("queue is full, drop exchange", "limit", s.limit, "event", ex.OpEvent, "group", ex.WorkerGroup)
+		return false
+	}
+	q.exchanges = append(q.exchanges, ex)
+	s.depth++
+	s.metrics.Set("scheduler.depth", int64(s.depth))
+	//ready中的组数不超过排队总数, 不会阻塞
+	if !q.queued && !q.running {
+		q.queued = true
+		s.ready <- ex.WorkerGroup
+	}
+	return true
+}
+
+//与排队中的请求合并, 调用方需持有锁:
+//1. 完全相同的请求只保留一个
+//2. 连续的切换请求合并为一次, 从最早的From切换到最新的To; 管理员发起的与自动的切换不合并, 以免事件记错发起方
+//3. 退出请求取代排队中的切换请求
+func (s *scheduler) coalesce(q *groupQueue, ex *Exchange) bool {
+	n := len(q.exchanges)
+	for _, pending := range q.exchanges {
+		if *pending == *ex {
+			return true
+		}
+	}
+	if n == 0 {
+		return false
+	}
+	last := q.exchanges[n-1]
+	switch {
+	case ex.OpEvent == UpdateEvent && last.OpEvent == UpdateEvent && last.Manual == ex.Manual:
+		last.To = ex.To
+		return true
+	case ex.OpEvent == ExitEvent:
+		kept := q.exchanges[:0]
+		for _, pending := range q.exchanges {
+			if pending.OpEvent != UpdateEvent {
+				kept = append(kept, pending)
+			}
+		}
+		merged := n - len(kept)
+		for i := len(kept); i < n; i++ {
+			q.exchanges[i] = nil
+		}
+		q.exchanges = kept
+		s.depth -= merged
+		s.metrics.Incr("scheduler.merged", int64(merged))
+	}
+	return false
+}
+
+//执行ready中的组, 直到ctx结束
+func (s *scheduler) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case group := <-s.ready:
+			s.drain(group)
+		}
+	}
+}
+
+//按顺序执行组内排队的请求
+func (s *scheduler) drain(group string) {
+	s.lock.Lock()
+	q := s.groups[group]
+	q.queued = false
+	q.running = true
+	for len(q.exchanges) > 0 {
+		ex := q.exchanges[0]
+		q.exchanges[0] = nil
+		q.exchanges = q.exchanges[1:]
+		s.depth--
+		s.metrics.Set("scheduler.depth", int64(s.depth))
+		s.lock.Unlock()
+
+		if err := s.handle(ex); err != nil {
+			//失败的请求不重新排队, 由提交方重试
+			s.metrics.Incr("scheduler.failed", 1)
+			s.log.Error("exchange failed", "group", group, "event", ex.OpEvent, "from", ex.From, "to", ex.To, "error", err)
+		}
+		s.metrics.Incr("scheduler.processed", 1)
+
+		s.lock.Lock()
+	}
+	q.running = false
+	delete(s.groups, group)
+	s.lock.Unlock()
+}
@@ -0,0 +1,164 @@
+package etcd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/domac/hasky/logger"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//写入leader失败的后端
+type failingBackend struct {
+	*MemoryBackend
+	fail bool
+}
+
+func (b *failingBackend) Set(key, value string) error {
+	if b.fail && strings.HasSuffix(key, "/leader") {
+		return errors.New("etcd unavailable")
+	}
+	return b.MemoryBackend.Set(key, value)
+}
+
+//leader写入失败时worker的状态不变, 不记录切换
+func TestExchangeLeaderWriteFailed(t *testing.T) {
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	registry := newTestRegistry(t, backend)
+	group := registry.Namespaces().Dirs()[0] + "/group"
+	backend.Set(group+"/members/agent-1/heartbeat", "agent-hb-1")
+	backend.Set(group+"/members/agent-2/heartbeat", "agent-hb-1")
+	backend.Set(group+"/leader", "agent-1")
+	registry.registWorker(group)
+	w := registry.getWorker(group)
+
+	backend.fail = true
+	ex := &Exchange{From: "agent-1", To: "agent-2", OpEvent: UpdateEvent, WorkerGroup: group}
+	if err := registry.handleExchange(ex); err == nil {
+		t.Fatal("leader write failure not reported")
+	}
+	if leader := w.getWorkingNode(); leader != "agent-1" {
+		t.Fatalf("worker leader changed to %s after failed write", leader)
+	}
+	if n := registry.Metrics().Get("failovers"); n != 0 || len(registry.Events().List(0, group, 0)) != 0 {
+		t.Fatalf("failed exchange recorded as failover: %d", n)
+	}
+
+	backend.fail = false
+	if err := registry.handleExchange(ex); err != nil {
+		t.Fatal(err)
+	}
+	if leader, _ := backend.Get(group + "/leader"); leader != "agent-2" || w.getWorkingNode() != "agent-2" {
+		t.Fatalf("leader is %s in etcd and %s in worker", leader, w.getWorkingNode())
+	}
+	if n := registry.Metrics().Get("failovers"); n != 1 {
+		t.Fatalf("failovers = %d, want 1", n)
+	}
+}
+
+//记录执行顺序的调度器, 组a的第一个请求阻塞到release关闭
+type recordingScheduler struct {
+	*scheduler
+	lock    sync.Mutex
+	handled []string
+	release chan struct{}
+}
+
+func newRecordingScheduler(t *testing.T, limit int) *recordingScheduler {
+	r := &recordingScheduler{release: make(chan struct{})}
+	started := make(chan struct{}, 1)
+	r.scheduler = newScheduler(2, limit, NewMetrics(), func(ex *Exchange) error {
+		if ex.WorkerGroup == "a" && ex.From == "blocker" {
+			started <- struct{}{}
+			<-r.release
+		}
+		r.lock.Lock()
+		r.handled = append(r.handled, fmt.Sprintf("%s:%s>%s manual=%v", ex.WorkerGroup, ex.From, ex.To, ex.Manual))
+		r.lock.Unlock()
+		return nil
+	})
+	r.scheduler.log = logger.New(ioutil.Discard, logger.FORMAT_LOGFMT)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for i := 0; i < r.workers; i++ {
+		go r.run(ctx)
+	}
+	r.submit(&Exchange{WorkerGroup: "a", From: "blocker", To: "x", OpEvent: UpdateEvent})
+	<-started
+	return r
+}
+
+//放行阻塞的请求, 等待所有请求执行完成
+func (r *recordingScheduler) finish(t *testing.T, want int) []string {
+	close(r.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.lock.Lock()
+		handled := append([]string(nil), r.handled...)
+		r.lock.Unlock()
+		if len(handled) >= want {
+			return handled
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %v, want %d exchanges", handled, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//排队中的连续切换合并为一次, 相同的请求只执行一次, 不同组互不影响
+func TestSchedulerCoalesce(t *testing.T) {
+	r := newRecordingScheduler(t, 16)
+	r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "y", OpEvent: UpdateEvent})
+	r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "y", OpEvent: UpdateEvent})
+	r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "z", OpEvent: UpdateEvent})
+	r.submit(&Exchange{WorkerGroup: "b", From: "1", To: "2", OpEvent: UpdateEvent})
+
+	handled := r.finish(t, 3)
+	want := []string{"a:blocker>x manual=false", "a:x>z manual=false"}
+	got := make([]string, 0)
+	for _, h := range handled {
+		if strings.HasPrefix(h, "a:") {
+			got = append(got, h)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("group a handled %v, want %v", got, want)
+	}
+	if n := r.metrics.Get("scheduler.merged"); n != 2 {
+		t.Fatalf("merged = %d, want 2", n)
+	}
+}
+
+//管理员发起的切换不与自动切换合并, 保留各自的发起方
+func TestSchedulerKeepsManualExchanges(t *testing.T) {
+	r := newRecordingScheduler(t, 16)
+	r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "y", OpEvent: UpdateEvent, Manual: true})
+	r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "z", OpEvent: UpdateEvent})
+
+	handled := r.finish(t, 3)
+	want := []string{"a:blocker>x manual=false", "a:x>y manual=true", "a:x>z manual=false"}
+	if fmt.Sprint(handled) != fmt.Sprint(want) {
+		t.Fatalf("handled %v, want %v", handled, want)
+	}
+}
+
+//排队总数达到上限时丢弃新的请求, 提交方不被阻塞
+func TestSchedulerQueueLimit(t *testing.T) {
+	r := newRecordingScheduler(t, 2)
+	if !r.submit(&Exchange{WorkerGroup: "a", From: "x", To: "y", OpEvent: UpdateEvent}) ||
+		!r.submit(&Exchange{WorkerGroup: "a", OpEvent: StopEvent}) {
+		t.Fatal("exchange dropped below the limit")
+	}
+	if r.submit(&Exchange{WorkerGroup: "a", From: "y", To: "z", OpEvent: UpdateEvent}) {
+		t.Fatal("exchange accepted over the limit")
+	}
+	r.finish(t, 3)
+	if n := r.metrics.Get("scheduler.dropped"); n != 1 {
+		t.Fatalf("dropped = %d, want 1", n)
+	}
+}
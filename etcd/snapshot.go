@@ -0,0 +1,206 @@
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/coreos/etcd/client"
+	"io"
+	"strings"
+	"time"
+)
+
+//快照格式的版本, 格式发生不兼容的变化时递增
+const SNAPSHOT_VERSION = 1
+
+//导入时遇到已存在且值不同的key的处理方式
+type ConflictPolicy string
+
+const (
+	CONFLICT_SKIP      ConflictPolicy = "skip"      //保留已有的值
+	CONFLICT_OVERWRITE ConflictPolicy = "overwrite" //使用快照中的值
+	CONFLICT_FAIL      ConflictPolicy = "fail"      //存在冲突时不做任何修改
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case CONFLICT_SKIP, CONFLICT_OVERWRITE, CONFLICT_FAIL:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q, must be skip, overwrite or fail", s)
+}
+
+//prefix下所有key的快照, 包括组、leader、策略、成员元数据与状态, 以及hasky写入的其他key
+//key保存为相对prefix的路径, 可以导入到使用不同prefix的集群
+type Snapshot struct {
+	Version   int            `json:"version"`
+	Prefix    string         `json:"prefix"`
+	CreatedAt time.Time      `json:"created_at"`
+	Keys      []*SnapshotKey `json:"keys"`
+	Excluded  []string       `json:"excluded,omitempty"` //没有导出的保存API令牌的key
+}
+
+type SnapshotKey struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Dir   bool   `json:"dir,omitempty"` //只记录空目录, 其他目录由其中的key隐含
+	TTL   int64  `json:"ttl,omitempty"` //剩余的过期时间(秒), 例如心跳
+}
+
+//导出prefix下的所有key, prefix不存在时返回空快照
+//心跳由agent持续写入, 导入旧的心跳会让成员短暂显示为失效, 因此默认不导出, 只保留成员目录
+//保存API令牌的key拿到快照即可使用其中的令牌, secrets为false时不导出, 只在Excluded中记录key
+func ExportSnapshot(backend Backend, prefix string, heartbeats, secrets bool) (*Snapshot, error) {
+	snap := &Snapshot{Version: SNAPSHOT_VERSION, Prefix: prefix, CreatedAt: time.Now(), Keys: make([]*SnapshotKey, 0)}
+	root, err := backend.GetTree(prefix)
+	if err != nil {
+		if client.IsKeyNotFound(err) {
+			return snap, nil
+		}
+		return nil, err
+	}
+	//返回目录下记录的key数量, 为0时由上层记录为空目录
+	var walk func(node *client.Node) int
+	walk = func(node *client.Node) int {
+		count := 0
+		for _, child := range node.Nodes {
+			if child.Dir && walk(child) > 0 {
+				count++
+				continue
+			}
+			if !heartbeats && !child.Dir && strings.HasSuffix(child.Key, "/heartbeat") && strings.Contains(child.Key, "/members/") {
+				continue
+			}
+			if !secrets && !child.Dir && isTokenValue(child.Value) {
+				snap.Excluded = append(snap.Excluded, strings.TrimPrefix(child.Key, prefix))
+				continue
+			}
+			snap.Keys = append(snap.Keys, &SnapshotKey{
+				Key:   strings.TrimPrefix(child.Key, prefix),
+				Value: child.Value,
+				Dir:   child.Dir,
+				TTL:   child.TTL,
+			})
+			count++
+		}
+		return count
+	}
+	walk(root)
+	return snap, nil
+}
+
+//值是否为令牌文件的格式且包含令牌, 与 auth-etcd-key 的内容相同, 不依赖key的位置
+func isTokenValue(value string) bool {
+	var tokens struct {
+		Token []struct {
+			Token string `toml:"token"`
+		} `toml:"token"`
+	}
+	if _, err := toml.Decode(value, &tokens); err != nil {
+		return false
+	}
+	for _, t := range tokens.Token {
+		if t.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+//读取快照文件并检查版本
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	snap := &Snapshot{}
+	if err := json.NewDecoder(r).Decode(snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	if snap.Version < 1 || snap.Version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d, this hasky supports up to %d", snap.Version, SNAPSHOT_VERSION)
+	}
+	for _, k := range snap.Keys {
+		if !strings.HasPrefix(k.Key, "/") || strings.Contains(k.Key, "/../") || strings.HasSuffix(k.Key, "/..") {
+			return nil, fmt.Errorf("invalid key %q in snapshot", k.Key)
+		}
+	}
+	return snap, nil
+}
+
+//导入的结果
+type ImportResult struct {
+	Created   int      `json:"created"`
+	Updated   int      `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+	Skipped   int      `json:"skipped"`
+	Conflicts []string `json:"conflicts"`
+	DryRun    bool     `json:"dry_run,omitempty"`
+}
+
+//将快照导入到prefix下, 快照中没有的key保持不变
+//conflict决定已存在且值不同的key如何处理, 目录与key类型不同的冲突总是跳过;
+//CONFLICT_FAIL时存在任何冲突都返回错误且不做修改; dryRun时只统计不写入
+func ImportSnapshot(backend Backend, prefix string, snap *Snapshot, conflict ConflictPolicy, dryRun bool) (*ImportResult, error) {
+	existing := make(map[string]*client.Node)
+	root, err := backend.GetTree(prefix)
+	if err != nil && !client.IsKeyNotFound(err) {
+		return nil, err
+	}
+	if root != nil {
+		var walk func(node *client.Node)
+		walk = func(node *client.Node) {
+			existing[node.Key] = node
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+		}
+		walk(root)
+	}
+
+	//先确定每个key的操作, 再统一写入
+	type write struct {
+		key *SnapshotKey
+		abs string
+	}
+	result := &ImportResult{Conflicts: make([]string, 0), DryRun: dryRun}
+	writes := make([]*write, 0, len(snap.Keys))
+	for _, k := range snap.Keys {
+		abs := prefix + k.Key
+		node, ok := existing[abs]
+		switch {
+		case !ok:
+			result.Created++
+			writes = append(writes, &write{k, abs})
+		case node.Dir != k.Dir:
+			result.Skipped++
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s: directory and key mismatch", abs))
+		case k.Dir || node.Value == k.Value:
+			result.Unchanged++
+		case conflict == CONFLICT_OVERWRITE:
+			result.Updated++
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s: overwritten", abs))
+			writes = append(writes, &write{k, abs})
+		default:
+			result.Skipped++
+			result.Conflicts = append(result.Conflicts, fmt.Sprintf("%s: kept existing value", abs))
+		}
+	}
+	if conflict == CONFLICT_FAIL && len(result.Conflicts) > 0 {
+		return result, fmt.Errorf("%d conflicting keys, nothing imported", len(result.Conflicts))
+	}
+	if dryRun {
+		return result, nil
+	}
+	for _, w := range writes {
+		var err error
+		switch {
+		case w.key.Dir:
+			err = backend.CreateDir(w.abs)
+		case w.key.TTL > 0:
+			err = backend.SetTtl(w.abs, w.key.Value, time.Duration(w.key.TTL)*time.Second)
+		default:
+			err = backend.Set(w.abs, w.key.Value)
+		}
+		if err != nil {
+			return result, fmt.Errorf("import %s failed: %v", w.abs, err)
+		}
+	}
+	return result, nil
+}
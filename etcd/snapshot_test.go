@@ -0,0 +1,93 @@
+package etcd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+const testTokens = `
+[[token]]
+name = "ops"
+token = "change-me"
+role = "admin"
+`
+
+func snapshotKeys(snap *Snapshot) map[string]string {
+	keys := make(map[string]string)
+	for _, k := range snap.Keys {
+		keys[k.Key] = k.Value
+	}
+	return keys
+}
+
+//令牌默认不导出, 只记录key; include secrets 时导出
+func TestSnapshotExcludesSecrets(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Set("/hasky/agent-groups/g1/leader", "agent-1")
+	backend.Set("/hasky/agent-groups/g1/members/agent-1/meta", `{"zone":"a"}`)
+	backend.Set("/hasky/auth/tokens", testTokens)
+	backend.Set("/hasky/custom/tokens", testTokens)
+	backend.Set("/hasky/auth/empty", "")
+
+	snap, err := ExportSnapshot(backend, "/hasky", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := snapshotKeys(snap)
+	if _, ok := keys["/auth/tokens"]; ok {
+		t.Fatal("tokens exported without secrets")
+	}
+	if _, ok := keys["/custom/tokens"]; ok {
+		t.Fatal("tokens outside auth-etcd-key exported without secrets")
+	}
+	if keys["/agent-groups/g1/leader"] != "agent-1" {
+		t.Fatalf("leader missing from snapshot: %v", keys)
+	}
+	if _, ok := keys["/auth/empty"]; !ok {
+		t.Fatalf("key without tokens left out: %v", keys)
+	}
+	if len(snap.Excluded) != 2 || snap.Excluded[0] != "/auth/tokens" || snap.Excluded[1] != "/custom/tokens" {
+		t.Fatalf("excluded = %v", snap.Excluded)
+	}
+
+	snap, err = ExportSnapshot(backend, "/hasky", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshotKeys(snap)["/auth/tokens"] != testTokens || len(snap.Excluded) != 0 {
+		t.Fatalf("tokens not exported with secrets, excluded = %v", snap.Excluded)
+	}
+}
+
+//导出后导入到不同的prefix, 已有的值按冲突策略处理
+func TestSnapshotRoundTrip(t *testing.T) {
+	src := NewMemoryBackend()
+	src.Set("/hasky/agent-groups/g1/leader", "agent-1")
+	src.Set("/hasky/agent-groups/g1/members/agent-1/heartbeat", "agent-hb-1")
+	src.CreateDir("/hasky/agent-groups/g2")
+	snap, err := ExportSnapshot(src, "/hasky", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(snap)
+	if snap, err = ReadSnapshot(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := NewMemoryBackend()
+	dst.Set("/other/agent-groups/g1/leader", "agent-2")
+	if _, err := ImportSnapshot(dst, "/other", snap, CONFLICT_FAIL, false); err == nil {
+		t.Fatal("conflict did not fail")
+	}
+	result, err := ImportSnapshot(dst, "/other", snap, CONFLICT_SKIP, false)
+	if err != nil || result.Created != 2 || result.Skipped != 1 {
+		t.Fatalf("import = %+v, %v", result, err)
+	}
+	if leader, _ := dst.Get("/other/agent-groups/g1/leader"); leader != "agent-2" {
+		t.Fatalf("skip overwrote leader with %s", leader)
+	}
+	if !dst.IsDirExist("/other/agent-groups/g2") {
+		t.Fatal("empty group not imported")
+	}
+}
@@ -0,0 +1,213 @@
+package etcd
+
+import (
+	"sort"
+	"time"
+)
+
+type MemberState string
+
+const (
+	//成员状态
+	STATE_JOINING  MemberState = "joining"
+	STATE_HEALTHY  MemberState = "healthy"
+	STATE_SUSPECT  MemberState = "suspect"
+	STATE_DEAD     MemberState = "dead"
+	STATE_DISABLED MemberState = "disabled"
+	STATE_DRAINING MemberState = "draining"
+
+	//每个成员保留的状态变迁记录数
+	STATE_HISTORY_SIZE = 16
+
+	//连续探测失败达到该次数视为dead
+	PROBE_DEAD_FAILURES = 3
+)
+
+//状态变迁记录
+type StateTransition struct {
+	From   MemberState `json:"from"`
+	To     MemberState `json:"to"`
+	Time   time.Time   `json:"time"`
+	Reason string      `json:"reason"`
+}
+
+//成员的健康状态
+type MemberStatus struct {
+	Name          string             `json:"name"`
+	State         MemberState        `json:"state"`
+	Since         time.Time          `json:"since"`
+	Reason        string             `json:"reason"`
+	LastHeartbeat time.Time          `json:"last_heartbeat"`
+	LastSeen      time.Time          `json:"last_seen"`
+	LastProbeErr  string             `json:"last_probe_error,omitempty"`
+	History       []*StateTransition `json:"history,omitempty"`
+
+	//抖动检测, 隔离期间不参与选举
+	Flaps            int       `json:"flaps"`
+	QuarantinedUntil time.Time `json:"quarantined_until"`
+}
+
+//成员状态机
+//心跳被重新写入说明agent还活着, 以hasky本地时间记录写入时刻, 不受agent时钟影响:
+//  joining  -> healthy  观察到心跳更新
+//  healthy  -> suspect  心跳超过 suspectTimeout 未更新, 或者探测失败
+//  suspect  -> healthy  心跳恢复更新且探测通过, 或者心跳正常时探测重新通过
+//  *        -> dead     心跳超过 deadTimeout 未更新, 或者连续探测失败
+//  dead     -> joining  心跳重新开始更新
+//disabled/draining 由管理员设置, 只能由管理员解除
+type memberTracker struct {
+	status        MemberStatus
+	meta          *MemberMeta
+	lastIndex     uint64
+	lastChange    time.Time
+	probeFailures int
+	quarantines   int
+	onTransit     func(*memberTracker, time.Time)
+}
+
+func newMemberTracker(name string, now time.Time) *memberTracker {
+	return &memberTracker{
+		status: MemberStatus{
+			Name:     name,
+			State:    STATE_JOINING,
+			Since:    now,
+			Reason:   "member discovered",
+			LastSeen: now,
+		},
+		lastChange: now,
+	}
+}
+
+func (t *memberTracker) transit(to MemberState, now time.Time, reason string) {
+	if t.status.State == to {
+		return
+	}
+	t.status.History = append(t.status.History, &StateTransition{
+		From:   t.status.State,
+		To:     to,
+		Time:   now,
+		Reason: reason,
+	})
+	if len(t.status.History) > STATE_HISTORY_SIZE {
+		t.status.History = t.status.History[len(t.status.History)-STATE_HISTORY_SIZE:]
+	}
+	t.status.State = to
+	t.status.Since = now
+	t.status.Reason = reason
+	if t.onTransit != nil {
+		t.onTransit(t, now)
+	}
+}
+
+//管理员设置的状态
+func (t *memberTracker) observeAdmin(admin string, now time.Time) {
+	switch MemberState(admin) {
+	case STATE_DISABLED, STATE_DRAINING:
+		t.transit(MemberState(admin), now, "set by admin")
+	default:
+		if t.status.State == STATE_DISABLED || t.status.State == STATE_DRAINING {
+			t.lastChange = now
+			t.transit(STATE_JOINING, now, "enabled by admin")
+		}
+	}
+}
+
+//观察到心跳写入, index为etcd中的修改序号, 旧的写入会被忽略
+//初次观察到的心跳只作为基准, 之后的写入才证明agent存活
+func (t *memberTracker) observeHeartbeat(value string, index uint64, now time.Time) {
+	if index <= t.lastIndex {
+		return
+	}
+	first := t.lastIndex == 0
+	t.lastIndex = index
+	t.lastChange = now
+	t.status.LastSeen = now
+	if hb, err := ParseHeartbeat(value); err == nil {
+		t.status.LastHeartbeat = hb
+	}
+	if first || t.isAdminState() {
+		return
+	}
+
+	switch t.status.State {
+	case STATE_DEAD:
+		t.transit(STATE_JOINING, now, "heartbeat resumed")
+	case STATE_JOINING:
+		t.transit(STATE_HEALTHY, now, "heartbeat confirmed")
+	case STATE_SUSPECT:
+		if t.probeFailures == 0 {
+			t.transit(STATE_HEALTHY, now, "heartbeat recovered")
+		}
+	}
+}
+
+//心跳被删除或者过期
+func (t *memberTracker) observeHeartbeatLost(index uint64, now time.Time) {
+	if index > t.lastIndex {
+		t.lastIndex = index
+	}
+	if !t.isAdminState() {
+		t.transit(STATE_DEAD, now, "heartbeat expired")
+	}
+}
+
+//按心跳的更新间隔推进状态
+func (t *memberTracker) checkAge(now time.Time, suspectTimeout, deadTimeout time.Duration) {
+	if t.isAdminState() {
+		return
+	}
+	age := now.Sub(t.lastChange)
+	switch {
+	case age > deadTimeout:
+		t.transit(STATE_DEAD, now, "heartbeat timeout")
+	case age > suspectTimeout:
+		if t.status.State != STATE_DEAD {
+			t.transit(STATE_SUSPECT, now, "heartbeat delayed")
+		}
+	}
+}
+
+//根据探测结果推进状态, 探测失败导致的suspect在心跳没有超过suspectTimeout时由探测通过恢复
+func (t *memberTracker) observeProbe(err error, now time.Time, suspectTimeout time.Duration) {
+	if err == nil {
+		t.status.LastProbeErr = ""
+		recovered := t.probeFailures > 0
+		t.probeFailures = 0
+		if recovered && t.status.State == STATE_SUSPECT && now.Sub(t.lastChange) <= suspectTimeout {
+			t.transit(STATE_HEALTHY, now, "probe recovered")
+		}
+		return
+	}
+	t.status.LastProbeErr = err.Error()
+	t.probeFailures++
+	if t.isAdminState() {
+		return
+	}
+	if t.probeFailures >= PROBE_DEAD_FAILURES {
+		t.transit(STATE_DEAD, now, "probe failed: "+err.Error())
+	} else if t.status.State != STATE_DEAD {
+		t.transit(STATE_SUSPECT, now, "probe failed: "+err.Error())
+	}
+}
+
+//因探测失败而可疑, 需要重新探测才能恢复
+func (t *memberTracker) probeSuspect() bool {
+	return t.status.State == STATE_SUSPECT && t.probeFailures > 0
+}
+
+func (t *memberTracker) isAdminState() bool {
+	return isAdminState(t.status.State)
+}
+
+func (t *memberTracker) snapshot() *MemberStatus {
+	status := t.status
+	status.History = make([]*StateTransition, len(t.status.History))
+	copy(status.History, t.status.History)
+	return &status
+}
+
+//按名称排序的成员状态
+func sortStatuses(statuses []*MemberStatus) []*MemberStatus {
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
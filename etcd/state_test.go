@@ -0,0 +1,136 @@
+package etcd
+
+import (
+	"errors"
+	"golang.org/x/net/context"
+	"net"
+	"testing"
+	"time"
+)
+
+const (
+	testSuspect = 3 * time.Second
+	testDead    = 10 * time.Second
+)
+
+func expectState(t *testing.T, tracker *memberTracker, want MemberState) {
+	t.Helper()
+	if tracker.status.State != want {
+		t.Fatalf("member is %s (%s), want %s", tracker.status.State, tracker.status.Reason, want)
+	}
+}
+
+//心跳驱动的状态变迁: joining -> healthy -> suspect -> dead -> joining
+func TestMemberHeartbeatStates(t *testing.T) {
+	now := time.Now()
+	tracker := newMemberTracker("agent-1", now)
+	tracker.observeHeartbeat(testHeartbeat(now), 1, now)
+	expectState(t, tracker, STATE_JOINING)
+	tracker.observeHeartbeat(testHeartbeat(now), 1, now.Add(time.Second))
+	expectState(t, tracker, STATE_JOINING)
+
+	now = now.Add(time.Second)
+	tracker.observeHeartbeat(testHeartbeat(now), 2, now)
+	expectState(t, tracker, STATE_HEALTHY)
+
+	tracker.checkAge(now.Add(testSuspect+time.Second), testSuspect, testDead)
+	expectState(t, tracker, STATE_SUSPECT)
+	tracker.checkAge(now.Add(testDead+time.Second), testSuspect, testDead)
+	expectState(t, tracker, STATE_DEAD)
+
+	now = now.Add(testDead + 2*time.Second)
+	tracker.observeHeartbeat(testHeartbeat(now), 3, now)
+	expectState(t, tracker, STATE_JOINING)
+	tracker.observeHeartbeat(testHeartbeat(now), 4, now.Add(time.Second))
+	expectState(t, tracker, STATE_HEALTHY)
+
+	tracker.observeHeartbeatLost(5, now.Add(2*time.Second))
+	expectState(t, tracker, STATE_DEAD)
+	if n := len(tracker.status.History); n != 6 {
+		t.Fatalf("%d transitions recorded, want 6", n)
+	}
+}
+
+//管理员设置的状态不受心跳与探测影响, 解除后重新开始加入
+func TestMemberAdminStates(t *testing.T) {
+	now := time.Now()
+	tracker := newMemberTracker("agent-1", now)
+	tracker.observeAdmin(string(STATE_DRAINING), now)
+	expectState(t, tracker, STATE_DRAINING)
+	tracker.observeHeartbeat(testHeartbeat(now), 1, now)
+	tracker.observeHeartbeat(testHeartbeat(now), 2, now)
+	tracker.observeProbe(errors.New("refused"), now, testSuspect)
+	tracker.checkAge(now.Add(testDead+time.Second), testSuspect, testDead)
+	expectState(t, tracker, STATE_DRAINING)
+
+	tracker.observeAdmin("", now)
+	expectState(t, tracker, STATE_JOINING)
+}
+
+//一次探测失败变为suspect, 心跳不能恢复, 探测重新通过后恢复; 连续失败变为dead
+func TestMemberProbeStates(t *testing.T) {
+	now := time.Now()
+	tracker := newMemberTracker("agent-1", now)
+	tracker.observeHeartbeat(testHeartbeat(now), 1, now)
+	tracker.observeHeartbeat(testHeartbeat(now), 2, now)
+	expectState(t, tracker, STATE_HEALTHY)
+
+	tracker.observeProbe(errors.New("refused"), now, testSuspect)
+	expectState(t, tracker, STATE_SUSPECT)
+	tracker.observeHeartbeat(testHeartbeat(now), 3, now.Add(time.Second))
+	expectState(t, tracker, STATE_SUSPECT)
+	if !tracker.probeSuspect() {
+		t.Fatal("member suspected by probe is not re-probed")
+	}
+	tracker.observeProbe(nil, now.Add(time.Second), testSuspect)
+	expectState(t, tracker, STATE_HEALTHY)
+
+	//心跳也已经延迟时, 探测通过不能恢复
+	tracker.observeProbe(errors.New("refused"), now, testSuspect)
+	tracker.observeProbe(nil, now.Add(testSuspect+2*time.Second), testSuspect)
+	expectState(t, tracker, STATE_SUSPECT)
+
+	for i := 0; i < PROBE_DEAD_FAILURES; i++ {
+		tracker.observeProbe(errors.New("refused"), now, testSuspect)
+	}
+	expectState(t, tracker, STATE_DEAD)
+}
+
+//检查时重新探测因探测失败而可疑的成员, leader恢复后不切换
+func TestKeepaliveReprobesSuspect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	registry := newTestRegistry(t, NewMemoryBackend())
+	worker := NewLeaderWorker(registry, time.Second, registry.Namespaces().Dirs()[0]+"/group")
+	leader := listener.Addr().String()
+	now := time.Now()
+	worker.lock.Lock()
+	worker.Policy = &GroupPolicy{Probes: []*ProbeConfig{{Type: PROBE_TCP, Timeout: "1s"}}}
+	worker.WorkingNode = leader
+	tracker := worker.tracker(leader, now)
+	tracker.observeHeartbeat(testHeartbeat(now), 1, now)
+	tracker.observeHeartbeat(testHeartbeat(now), 2, now)
+	tracker.observeProbe(errors.New("timeout"), now, worker.suspectTimeout())
+	worker.lock.Unlock()
+
+	worker.Keepalive(context.Background())
+	worker.lock.RLock()
+	defer worker.lock.RUnlock()
+	expectState(t, tracker, STATE_HEALTHY)
+	if worker.WorkingNode != leader {
+		t.Fatalf("leader changed to %q", worker.WorkingNode)
+	}
+}
@@ -3,23 +3,39 @@ package etcd
 import (
 	"errors"
 	"fmt"
-	log "github.com/alecthomas/log4go"
+	"github.com/coreos/etcd/client"
+	"github.com/domac/hasky/logger"
+	"golang.org/x/net/context"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const INCR int32 = 1
-
 //服务服务Leader的Woker
-//一个组一个worker
+//一个组一个worker, 导出的字段由lock保护, 外部通过Snapshot读取
 type LeaderWorker struct {
+	lock            sync.RWMutex
+	running         int32
+	queued          int32
+	timer           *time.Timer
+	stopped         bool
 	registry        *EtcdRegistry
 	Group           string
 	WorkingNode     string
 	LastWorkingNode string
 	KeepalivePeriod time.Duration
 	LastKeepalive   time.Time
+	Policy          *GroupPolicy
+	LastProbeError  string
+	LastProbeTime   time.Time
+	states          map[string]*memberTracker
+	failovers       []time.Time
+	dampedUntil     time.Time
+	suppressReason  string
+	log             *logger.Logger
 }
 
 //创建判官
@@ -27,162 +43,571 @@ func NewLeaderWorker(reg *EtcdRegistry, period time.Duration, group string) *Lea
 	return &LeaderWorker{
 		registry:        reg,
 		KeepalivePeriod: period,
-		Group:           group}
+		Group:           group,
+		states:          make(map[string]*memberTracker),
+		log:             reg.logger.Named("worker").With("group", group)}
+}
+
+//worker状态快照
+type WorkerSnapshot struct {
+	Group           string
+	WorkingNode     string
+	LastWorkingNode string
+	LastKeepalive   time.Time
+	LastProbeError  string
+	LastProbeTime   time.Time
+	Members         []*MemberInfo
+	States          []*MemberStatus
+}
+
+//组的概况, GET /groups 的响应
+type GroupSummary struct {
+	Group          string      `json:"group"`
+	Leader         string      `json:"leader"`
+	LeaderState    MemberState `json:"leader_state,omitempty"`
+	Members        int         `json:"members"`
+	Healthy        int         `json:"healthy"`
+	LastProbeError string      `json:"last_probe_error,omitempty"`
+	Declared       bool        `json:"declared,omitempty"`
+	MissingMembers []string    `json:"missing_members,omitempty"`
+}
+
+func (self *LeaderWorker) Snapshot() *WorkerSnapshot {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return &WorkerSnapshot{
+		Group:           self.Group,
+		WorkingNode:     self.WorkingNode,
+		LastWorkingNode: self.LastWorkingNode,
+		LastKeepalive:   self.LastKeepalive,
+		LastProbeError:  self.LastProbeError,
+		LastProbeTime:   self.LastProbeTime,
+		Members:         self.memberInfos(),
+		States:          self.memberStatuses(),
+	}
+}
+
+//所有成员的状态副本, 调用方需持有锁
+func (self *LeaderWorker) memberStatuses() []*MemberStatus {
+	statuses := make([]*MemberStatus, 0, len(self.states))
+	for _, t := range self.states {
+		statuses = append(statuses, t.snapshot())
+	}
+	return sortStatuses(statuses)
+}
+
+//成员的状态, 成员不存在时返回nil
+func (self *LeaderWorker) MemberStatus(member string) *MemberStatus {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if t, ok := self.states[member]; ok {
+		return t.snapshot()
+	}
+	return nil
+}
+
+//心跳超过该时间未更新视为suspect
+func (self *LeaderWorker) suspectTimeout() time.Duration {
+	return 3 * self.KeepalivePeriod
+}
+
+//心跳超过该时间未更新视为dead
+func (self *LeaderWorker) deadTimeout() time.Duration {
+	return 10 * self.KeepalivePeriod
+}
+
+//由状态机生成的成员信息, 调用方需持有锁
+func (self *LeaderWorker) memberInfos() []*MemberInfo {
+	members := make([]*MemberInfo, 0, len(self.states))
+	for name, t := range self.states {
+		members = append(members, &MemberInfo{
+			Group:         self.registry.namespaces.GroupName(self.Group),
+			Name:          name,
+			Meta:          t.meta,
+			Leader:        name == self.WorkingNode,
+			LastHeartbeat: t.status.LastHeartbeat,
+		})
+	}
+	self.fillStates(members)
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+func (self *LeaderWorker) tracker(member string, now time.Time) *memberTracker {
+	t, ok := self.states[member]
+	if !ok {
+		t = newMemberTracker(member, now)
+		t.onTransit = self.checkFlap
+		self.states[member] = t
+	}
+	return t
+}
+
+//根据组的节点树校正所有成员的状态, 调用方需持有锁
+//节点树可能比watch收到的事件旧, 只移除在快照之后没有更新过的成员
+func (self *LeaderWorker) observeGroup(groupNode *client.Node, now time.Time) {
+	seen := make(map[string]bool)
+	var snapshotIndex uint64
+	for _, n := range groupNode.Nodes {
+		if n.ModifiedIndex > snapshotIndex {
+			snapshotIndex = n.ModifiedIndex
+		}
+		if n.Key != self.Group+"/members" {
+			continue
+		}
+		for _, mn := range n.Nodes {
+			if !mn.Dir {
+				continue
+			}
+			name := mn.Key[strings.LastIndex(mn.Key, "/")+1:]
+			seen[name] = true
+			t := self.tracker(name, now)
+			for _, f := range mn.Nodes {
+				if f.ModifiedIndex > snapshotIndex {
+					snapshotIndex = f.ModifiedIndex
+				}
+				self.observeMemberFile(t, f.Key[len(mn.Key)+1:], f.Value, f.ModifiedIndex, now)
+			}
+			if childValue(mn, mn.Key+"/state") == "" {
+				t.observeAdmin("", now)
+			}
+		}
+	}
+	for name, t := range self.states {
+		if !seen[name] && t.lastIndex <= snapshotIndex {
+			delete(self.states, name)
+		}
+	}
+	self.ensureTimer(now)
+}
+
+func (self *LeaderWorker) observeMemberFile(t *memberTracker, file, value string, index uint64, now time.Time) {
+	switch file {
+	case "heartbeat":
+		t.observeHeartbeat(value, index, now)
+	case "state":
+		t.observeAdmin(value, now)
+	case "meta":
+		meta, err := ParseMemberMeta(value)
+		if err != nil {
+			self.log.Error("invalid member meta", "member", t.status.Name, "error", err)
+			return
+		}
+		t.meta = meta
+	}
+}
+
+//处理watch收到的成员事件, 返回是否需要立即重新检查:
+//leader的状态发生变化, 或者leader不可用时其他成员的状态发生变化
+func (self *LeaderWorker) onMemberEvent(action, member, file string, node *client.Node) bool {
+	now := time.Now()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	defer self.ensureTimer(now)
+
+	removed := action == "delete" || action == "expire" || action == "compareAndDelete"
+	if removed && file == "" {
+		delete(self.states, member)
+		return member == self.WorkingNode
+	}
+	t := self.tracker(member, now)
+	before := t.status.State
+	switch {
+	case removed && file == "heartbeat":
+		t.observeHeartbeatLost(node.ModifiedIndex, now)
+	case removed && file == "state":
+		t.observeAdmin("", now)
+	case removed && file == "meta":
+		t.meta = nil
+	case !removed:
+		self.observeMemberFile(t, file, node.Value, node.ModifiedIndex, now)
+	}
+	if before == t.status.State || self.WorkingNode == "" {
+		return false
+	}
+	return member == self.WorkingNode || !self.leaderAlive()
+}
+
+//leader是否处于可用状态, 调用方需持有锁
+func (self *LeaderWorker) leaderAlive() bool {
+	t, ok := self.states[self.WorkingNode]
+	return ok && (t.status.State == STATE_JOINING || t.status.State == STATE_HEALTHY)
+}
+
+//下一次需要检查的时间: 最早到期的心跳超时, 配置了主动探测或leader不可用, 以及有成员需要重新探测时还包括固定的检查间隔
+//返回false表示在新的事件到来之前不需要检查, 调用方需持有锁
+func (self *LeaderWorker) nextCheck(now time.Time) (time.Duration, bool) {
+	var next time.Time
+	reprobe := false
+	for _, t := range self.states {
+		reprobe = reprobe || t.probeSuspect()
+		var deadline time.Time
+		switch t.status.State {
+		case STATE_JOINING, STATE_HEALTHY:
+			deadline = t.lastChange.Add(self.suspectTimeout())
+		case STATE_SUSPECT:
+			deadline = t.lastChange.Add(self.deadTimeout())
+		default:
+			continue
+		}
+		if next.IsZero() || deadline.Before(next) {
+			next = deadline
+		}
+	}
+	//配置了主动探测, 或者leader不可用需要重试切换, 或者有成员需要重新探测时, 按固定间隔检查
+	probing := self.Policy != nil && len(self.Policy.Probes) > 0
+	if reprobe || (self.WorkingNode != "" && (probing || !self.leaderAlive())) {
+		if checkAt := now.Add(self.registry.Config().CheckInterval); next.IsZero() || checkAt.Before(next) {
+			next = checkAt
+		}
+	}
+	if next.IsZero() {
+		return 0, false
+	}
+	//超时的判断是严格大于, 多等一毫秒避免提前触发
+	d := next.Sub(now) + time.Millisecond
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+//按下一次检查的时间重新设置定时器, 调用方需持有锁
+func (self *LeaderWorker) armTimer(now time.Time) {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+	if self.stopped {
+		return
+	}
+	d, ok := self.nextCheck(now)
+	if !ok {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		self.lock.Lock()
+		if self.timer == timer {
+			self.timer = nil
+		}
+		self.lock.Unlock()
+		self.registry.enqueueCheck(self)
+	})
+	self.timer = timer
+}
+
+//没有等待中的定时器时设置定时器, 调用方需持有锁
+func (self *LeaderWorker) ensureTimer(now time.Time) {
+	if self.timer == nil {
+		self.armTimer(now)
+	}
+}
+
+//检查结束后重新设置定时器
+func (self *LeaderWorker) reschedule() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.armTimer(time.Now())
+}
+
+//把状态机的结果填充到成员信息中, 调用方需持有锁
+func (self *LeaderWorker) fillStates(members []*MemberInfo) {
+	for _, m := range members {
+		if t, ok := self.states[m.Name]; ok {
+			m.State = t.status.State
+			m.StateSince = t.status.Since
+			m.StateReason = t.status.Reason
+			m.Healthy = t.status.State == STATE_HEALTHY
+		}
+	}
+}
+
+func (self *LeaderWorker) getWorkingNode() string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.WorkingNode
+}
+
+func (self *LeaderWorker) setWorkingNode(node string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.WorkingNode = node
+}
+
+func (self *LeaderWorker) getPolicy() *GroupPolicy {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	return self.Policy
 }
 
+//停止worker, 不再进行检查
 func (self *LeaderWorker) StopWorking() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
 	self.WorkingNode = ""
+	self.stopped = true
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
 }
 
+//从etcd加载leader与成员的初始状态
 func (self *LeaderWorker) StartWorking() {
-	leader := self.registry.GetGroupLeader(self.Group)
-	if leader != "" {
-		self.WorkingNode = leader
+	groupNode, err := self.registry.registryClient.GetTree(self.Group)
+	if err != nil {
+		self.log.Error("load group failed", "error", err)
+	} else {
+		self.lock.Lock()
+		if leader := childValue(groupNode, self.Group+"/leader"); leader != "" {
+			self.WorkingNode = leader
+		}
+		self.observeGroup(groupNode, time.Now())
+		self.lock.Unlock()
 	}
+	self.LoadPolicy()
 }
 
-//需要做得工作：
-//1. 检查所属的组是否存在,如果不存在,则告诉注册器,把自己干掉
-//2. 检查监控的agent是否还存在
-//3. 检查监控的agent心跳
-func (self *LeaderWorker) Keepalive() {
-	if self.WorkingNode == "" {
-		log.Info("[%s] Worker is not working", self.Group)
+//加载组策略, 没有开启exec探针时忽略其中的exec探针
+//能写入etcd的人不应该因此可以在hasky所在的机器上执行命令
+func (self *LeaderWorker) LoadPolicy() {
+	policy, err := self.registry.GetGroupPolicy(self.Group)
+	if err != nil {
+		self.log.Error("load group policy failed", "error", err)
 		return
 	}
+	if !self.registry.Config().ExecProbes {
+		if filtered, n := policy.withoutExec(); n > 0 {
+			self.log.Warn("exec probes are disabled, ignoring them", "probes", n)
+			self.registry.metrics.Incr("probe.exec_ignored", int64(n))
+			policy = filtered
+		}
+	}
+	self.lock.Lock()
+	self.Policy = policy
+	self.lock.Unlock()
+}
 
-	hbdir := self.Group + "/members/" + self.WorkingNode + "/heartbeat"
-	_, err := self.registry.registryClient.GetDirChildren(self.Group)
-	if err != nil {
-		log.Error("worker get [%s] group error", self.Group)
-		self.Exit()
-		return
+//对成员执行主动探测, 记录探测结果
+func (self *LeaderWorker) probe(member string) error {
+	policy := self.getPolicy()
+	var err error
+	if policy != nil && len(policy.Probes) > 0 {
+		err = policy.Probe(self.Group, member, self.memberAddress(member))
+	} else if !self.isProbeSuspect(member) {
+		//没有配置探测时只清除策略修改前留下的探测失败
+		return nil
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if t, ok := self.states[member]; ok {
+		t.observeProbe(err, time.Now(), self.suspectTimeout())
 	}
-	//如果成员节点不存在，表示组已经被删除了
-	agentHeartBeatValue, err := self.registry.registryClient.Get(hbdir)
+	self.LastProbeTime = time.Now()
 	if err != nil {
-		log.Error("worker get [%s] heartbeat error", hbdir)
-		return
+		self.LastProbeError = err.Error()
+	} else {
+		self.LastProbeError = ""
 	}
+	return err
+}
+
+func (self *LeaderWorker) isProbeSuspect(member string) bool {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	t, ok := self.states[member]
+	return ok && t.probeSuspect()
+}
 
-	if agentHeartBeatValue == "" {
-		//TODO: 找新的
+//需要做得工作：
+//1. 按心跳的更新间隔推进组内所有成员的状态, 重新探测因探测失败而可疑的成员
+//2. 检查监控的agent的状态, 不健康时选出新的leader
+//成员心跳由watch实时更新, 这里不访问etcd; 检查由定时器或成员事件触发, 见 EtcdRegistry.enqueueCheck
+//同一个worker上一次检查未结束时, 本次检查直接跳过
+func (self *LeaderWorker) Keepalive(ctx context.Context) {
+	if ctx.Err() != nil || !atomic.CompareAndSwapInt32(&self.running, 0, 1) {
+		return
 	}
+	defer atomic.StoreInt32(&self.running, 0)
 
-	//检查当前工作节点的心跳
-	isTimeOut, err := self.checkTimeout(agentHeartBeatValue)
+	now := time.Now()
+	self.lock.Lock()
+	suspects := make([]string, 0)
+	for name, t := range self.states {
+		t.checkAge(now, self.suspectTimeout(), self.deadTimeout())
+		if t.probeSuspect() {
+			suspects = append(suspects, name)
+		}
+	}
+	self.lock.Unlock()
 
-	//检查过后，刷新状态
-	self.LastWorkingNode = self.WorkingNode
-
-	//如果发生了超时现象:
-	if err != nil || isTimeOut {
-		//找出替代工作的节点
-		aliveNode, err := self.FindGroupAliveNode()
-		if err != nil || aliveNode == "" {
-			//没找到工作节点
-			log.Error(err)
+	//心跳不会清除探测失败, 不重新探测的话成员一直无法参与选举
+	for _, member := range suspects {
+		if ctx.Err() != nil {
 			return
 		}
-		//找到工作节点
-		if aliveNode != "" && aliveNode != self.GetNodeId(self.LastWorkingNode) {
-			log.Info("[EXCHANGE] new leader was found [%s], request to update", aliveNode)
-			ex := &Exchange{
-				From:        self.LastWorkingNode,
-				To:          self.GetNodeId(aliveNode),
-				OpEvent:     UpdateEvent,
-				WorkerGroup: self.Group,
-			}
-			//请求调度器进行替换
-			self.registry.exchangeChan <- ex
+		self.probe(member)
+	}
+
+	self.lock.Lock()
+	workingNode := self.WorkingNode
+	var leaderStatus *MemberStatus
+	if t, ok := self.states[workingNode]; ok {
+		leaderStatus = t.snapshot()
+		self.LastKeepalive = t.lastChange
+	}
+	self.lock.Unlock()
+
+	if workingNode == "" {
+		self.log.Debug("group has no leader")
+		return
+	}
+
+	//检查当前工作节点的状态, 状态正常时再进行主动探测
+	reason := ""
+	switch {
+	case leaderStatus == nil:
+		reason = "member not found"
+	case leaderStatus.State == STATE_JOINING || leaderStatus.State == STATE_HEALTHY:
+		if probeErr := self.probe(workingNode); probeErr != nil {
+			self.log.Error("leader probe failed", "member", workingNode, "error", probeErr)
+			reason = probeErr.Error()
 		}
-	} else {
+	default:
+		reason = string(leaderStatus.State) + ": " + leaderStatus.Reason
+	}
+
+	//检查过后，刷新状态
+	self.lock.Lock()
+	self.LastWorkingNode = workingNode
+	self.lock.Unlock()
+
+	if reason == "" {
 		//心跳正常
-		log.Info("[SUCCESS][%s/members/%s] ALIVED!", self.Group, self.WorkingNode)
+		self.log.Debug("leader alive", "member", workingNode)
+		return
+	}
+
+	//找出替代工作的节点
+	self.log.Info("leader unavailable", "member", workingNode, "reason", reason)
+	if self.damped(time.Now()) {
+		//切换过于频繁, 抑制期结束后由重试检查继续切换
+		self.log.Warn("failover damped, keep leader", "member", workingNode)
+		self.registry.metrics.Incr("flap.suppressed", 1)
+		return
+	}
+	if allowed, why := self.registry.failoverAllowed(); !allowed {
+		self.suppressFailover(workingNode, why)
+		return
+	}
+	aliveNode, err := self.findGroupAliveNode(workingNode)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil || aliveNode == "" {
+		//没找到工作节点
+		self.log.Error("no leader candidate", "leader", workingNode, "error", err)
+		return
+	}
+	//找到工作节点
+	self.log.Info("new leader found, request to update", "from", workingNode, "to", aliveNode)
+	ex := &Exchange{
+		From:        workingNode,
+		To:          aliveNode,
+		OpEvent:     UpdateEvent,
+		WorkerGroup: self.Group,
+	}
+	//请求调度器进行替换, 队列已满时由下一次检查重试
+	self.lock.Lock()
+	self.suppressReason = ""
+	self.lock.Unlock()
+	self.registry.submit(ex)
+}
+
+//拒绝切换, 原因变化时记录事件
+func (self *LeaderWorker) suppressFailover(workingNode, reason string) {
+	self.log.Warn("failover suppressed, keep leader", "member", workingNode, "reason", reason)
+	self.registry.metrics.Incr("failover.suppressed", 1)
+	self.lock.Lock()
+	changed := self.suppressReason != reason
+	self.suppressReason = reason
+	self.lock.Unlock()
+	if changed {
+		self.registry.events.Add(EVENT_SUPPRESSED, self.Group, workingNode, "failover suppressed: %s", reason)
 	}
 }
 
-//检查超时情况
-func (self *LeaderWorker) checkTimeout(agentHb string) (bool, error) {
+//解析心跳值中的时间戳, 格式为 xxx-xxx-timestamp
+func ParseHeartbeat(agentHb string) (time.Time, error) {
 	hbs := strings.Split(agentHb, "-")
 	if len(hbs) < 3 {
-		return false, errors.New("worker get heartbeat value error")
+		return time.Time{}, errors.New("worker get heartbeat value error")
 	}
 	//获取心跳的当前时间戳
 	hb := hbs[2]
 	if hb == "" {
-		return false, errors.New("worker get heartbeat value null")
+		return time.Time{}, errors.New("worker get heartbeat value null")
 	}
 
 	//取时间
 	hbtm, err := strconv.ParseInt(hb, 10, 64)
 
 	if err != nil {
-		return false, errors.New("worker parse heartbeat value error")
+		return time.Time{}, errors.New("worker parse heartbeat value error")
 	}
+	return time.Unix(hbtm, 0), nil
+}
 
-	//当前的心跳时间
-	currentHeatBeatTime := time.Unix(hbtm, 0)
-
-	//self.LastWorkingNode = agent //上一个检查的节点
-	subtime := currentHeatBeatTime.Sub(self.LastKeepalive)
-
-	//时间间隔超过规定的区间
-	if subtime < self.KeepalivePeriod {
-		return true, nil
-	} else {
-		//没有超时
-		self.LastKeepalive = currentHeatBeatTime
-		return false, nil
+//成员的探测地址, 优先使用元数据中登记的地址
+func (self *LeaderWorker) memberAddress(member string) string {
+	self.lock.RLock()
+	defer self.lock.RUnlock()
+	if t, ok := self.states[member]; ok && t.meta != nil {
+		return t.meta.Endpoint(member)
 	}
+	return member
 }
 
 func (self *LeaderWorker) GetNodeId(nodePath string) string {
 	index := strings.Index(nodePath, "/members/")
+	if index < 0 {
+		return nodePath
+	}
 	memberName := nodePath[index+len("/members/"):]
 	return memberName
 }
 
 //找出组下存活的节点
 func (self *LeaderWorker) FindGroupAliveNode() (string, error) {
-	members, err := self.registry.registryClient.GetDirChildren(self.Group + "/members")
-	if err != nil {
-		log.Error("[%s] No Members Found !", self.Group)
-	}
-	//找出能用的节点
-	if len(members) > 0 {
-		for _, member := range members {
-
-			index := strings.Index(member, "/members/")
-			memberName := member[index+len("/members/"):]
-
-			if memberName == self.WorkingNode {
-				continue
-			}
-			hbdir := member + "/heartbeat"
-			agentHeartBeatValue, err := self.registry.registryClient.Get(hbdir)
-			if err != nil {
-				continue
-			}
+	return self.findGroupAliveNode(self.getWorkingNode())
+}
 
-			isTimeOut, err := self.checkTimeout(agentHeartBeatValue)
+//只有状态为healthy, 没有被隔离且探测通过的成员才能成为leader
+func (self *LeaderWorker) findGroupAliveNode(workingNode string) (string, error) {
+	now := time.Now()
+	self.lock.RLock()
+	candidates := make([]string, 0)
+	for _, status := range self.memberStatuses() {
+		if status.Name == workingNode || status.State != STATE_HEALTHY {
+			continue
+		}
+		if now.Before(status.QuarantinedUntil) {
+			self.log.Info("candidate quarantined", "member", status.Name, "until", status.QuarantinedUntil)
+			continue
+		}
+		candidates = append(candidates, status.Name)
+	}
+	self.lock.RUnlock()
 
-			if err != nil || isTimeOut {
-				continue
-			}
-			return member, nil
+	for _, member := range candidates {
+		if err := self.probe(member); err != nil {
+			self.log.Info("candidate rejected", "member", member, "error", err)
+			continue
 		}
+		return member, nil
 	}
 	errMsg := fmt.Sprintf("[ERROR] No Alive Node For Leader Found In %s", self.Group)
 	return "", errors.New(errMsg)
 }
-
-func (self *LeaderWorker) Exit() {
-	log.Info("worker exit now")
-	self.WorkingNode = ""
-	exitEvt := &Exchange{
-		OpEvent:     ExitEvent,
-		WorkerGroup: self.Group,
-	}
-	self.registry.exchangeChan <- exitEvt
-}
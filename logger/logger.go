@@ -0,0 +1,270 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//日志级别
+type Level int32
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DEBUG || l > ERROR {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+//解析日志级别: debug, info, warn 或 error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return INFO, fmt.Errorf("invalid log level %q, must be one of debug/info/warn/error", s)
+}
+
+//解析各组件的日志级别, 格式为 component=level,component=level
+func ParseLevels(spec string) (map[string]Level, error) {
+	levels := make(map[string]Level)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid log level %q, must be component=level", item)
+		}
+		level, err := ParseLevel(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		levels[strings.TrimSpace(parts[0])] = level
+	}
+	return levels, nil
+}
+
+//输出格式
+type Format string
+
+const (
+	FORMAT_LOGFMT Format = "logfmt"
+	FORMAT_JSON   Format = "json"
+)
+
+//解析输出格式: logfmt 或 json
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case FORMAT_LOGFMT, FORMAT_JSON:
+		return Format(s), nil
+	}
+	return FORMAT_LOGFMT, fmt.Errorf("invalid log format %q, must be logfmt or json", s)
+}
+
+//同一个根日志器派生出的所有日志器共享输出与级别, 级别与格式可以在运行中修改
+type sink struct {
+	lock   sync.Mutex
+	out    io.Writer
+	format atomic.Value //Format
+	level  int32
+	levels atomic.Value //map[string]Level, 整体替换
+}
+
+//结构化的日志器, 每条日志带有组件名与附加的字段
+type Logger struct {
+	sink      *sink
+	component string
+	fields    []interface{}
+}
+
+var std = New(os.Stderr, FORMAT_LOGFMT)
+
+//默认的日志器, 没有注入日志器时使用
+func Default() *Logger {
+	return std
+}
+
+//创建根日志器, 默认级别为info
+func New(out io.Writer, format Format) *Logger {
+	s := &sink{out: out, level: int32(INFO)}
+	s.format.Store(format)
+	s.levels.Store(map[string]Level{})
+	return &Logger{sink: s}
+}
+
+//派生指定组件的日志器, 组件名用于按组件设置级别
+func (l *Logger) Named(component string) *Logger {
+	l = l.orDefault()
+	return &Logger{sink: l.sink, component: component, fields: l.fields}
+}
+
+//派生带有附加字段的日志器, 参数为 key, value, key, value...
+func (l *Logger) With(kv ...interface{}) *Logger {
+	l = l.orDefault()
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{sink: l.sink, component: l.component, fields: fields}
+}
+
+//设置默认级别, 对所有共享输出的日志器生效
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.orDefault().sink.level, int32(level))
+}
+
+//设置各组件的级别, 覆盖默认级别, 未列出的组件使用默认级别
+func (l *Logger) SetLevels(levels map[string]Level) {
+	copied := make(map[string]Level, len(levels))
+	for component, level := range levels {
+		copied[component] = level
+	}
+	l.orDefault().sink.levels.Store(copied)
+}
+
+//设置输出格式
+func (l *Logger) SetFormat(format Format) {
+	l.orDefault().sink.format.Store(format)
+}
+
+//该级别的日志是否会输出
+func (l *Logger) Enabled(level Level) bool {
+	l = l.orDefault()
+	if min, ok := l.sink.levels.Load().(map[string]Level)[l.component]; ok {
+		return level >= min
+	}
+	return level >= Level(atomic.LoadInt32(&l.sink.level))
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(DEBUG, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(INFO, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(WARN, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(ERROR, msg, kv)
+}
+
+//没有注入日志器(nil)时使用默认日志器
+func (l *Logger) orDefault() *Logger {
+	if l == nil {
+		return std
+	}
+	return l
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	l = l.orDefault()
+	if !l.Enabled(level) {
+		return
+	}
+	keys := []string{"time", "level"}
+	values := []interface{}{time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), level.String()}
+	if l.component != "" {
+		keys = append(keys, "component")
+		values = append(values, l.component)
+	}
+	keys = append(keys, "msg")
+	values = append(values, msg)
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			keys = append(keys, fmt.Sprint(fields[i]))
+			if i+1 < len(fields) {
+				values = append(values, fields[i+1])
+			} else {
+				values = append(values, nil)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if l.sink.format.Load().(Format) == FORMAT_JSON {
+		encodeJSON(&buf, keys, values)
+	} else {
+		encodeLogfmt(&buf, keys, values)
+	}
+	buf.WriteByte('\n')
+	l.sink.lock.Lock()
+	l.sink.out.Write(buf.Bytes())
+	l.sink.lock.Unlock()
+}
+
+//字段值统一转为字符串或数字
+func fieldValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return value.String()
+	case string, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return value
+	}
+	return fmt.Sprint(v)
+}
+
+func encodeLogfmt(buf *bytes.Buffer, keys []string, values []interface{}) {
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		s := fmt.Sprint(fieldValue(values[i]))
+		if values[i] == nil {
+			s = ""
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, keys []string, values []interface{}) {
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(fieldValue(values[i]))
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(values[i]))
+		}
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+}
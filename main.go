@@ -5,12 +5,19 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/domac/hasky/app"
+	"github.com/domac/hasky/bench"
+	"github.com/domac/hasky/ctl"
+	"github.com/domac/hasky/doctor"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"github.com/domac/hasky/snapshot"
 	"github.com/judwhite/go-svc/svc"
 	"github.com/mreiferson/go-options"
-	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 var (
@@ -18,12 +25,68 @@ var (
 	showVersion  = flagSet.Bool("version", false, "print version string") //版本
 	config       = flagSet.String("config", "", "path to config file")
 	httpAddress  = flagSet.String("http-address", "0.0.0.0:16630", "<addr>:<port> to listen on for HTTP clients")
+	httpDrain    = flagSet.Duration("http-drain-timeout", 5*time.Second, "time to wait for in-flight HTTP requests on shutdown")
+	httpsCert    = flagSet.String("https-cert", "", "certificate file to serve the HTTP API over https")
+	httpsKey     = flagSet.String("https-key", "", "key file to serve the HTTP API over https")
+	httpsCACert  = flagSet.String("https-client-cacert", "", "CA bundle to require and verify client certificates (mTLS)")
+	authTokens   = flagSet.String("auth-token-file", "", "toml file with API tokens, roles and group scopes, auth is disabled if empty")
+	authEtcdKey  = flagSet.String("auth-etcd-key", "", "etcd key holding API tokens in the token file format, relative to etcd-prefix unless absolute")
+	authRefresh  = flagSet.Duration("auth-refresh-interval", 30*time.Second, "how often to reload API tokens from auth-etcd-key")
 	etcdEndpoint = flagSet.String("etcd-endpoint", "0.0.0.0:2379", "ectd service discovery address")
+	etcdPrefix   = flagSet.String("etcd-prefix", "/hasky", "root path of all keys hasky reads and writes in etcd")
+	namespaces   = flagSet.String("namespaces", "agent-groups", "comma separated namespaces under etcd-prefix to discover groups from, the first one is the default")
+	etcdCert     = flagSet.String("etcd-cert", "", "client certificate file for etcd tls")
+	etcdKey      = flagSet.String("etcd-key", "", "client key file for etcd tls")
+	etcdCACert   = flagSet.String("etcd-cacert", "", "CA bundle to verify the etcd server certificate")
+	etcdUsername = flagSet.String("etcd-username", "", "username for etcd authentication")
+	etcdPassword = flagSet.String("etcd-password", "", "password for etcd authentication")
+	dnsAddress   = flagSet.String("dns-address", "", "<addr>:<port> to listen on for DNS queries, disabled if empty")
+	dnsDomain    = flagSet.String("dns-domain", "hasky.", "DNS domain served by the embedded DNS server")
+	groupsDir    = flagSet.String("groups-dir", "", "directory of *.toml group definitions applied to etcd, disabled if empty")
+	groupsSync   = flagSet.Duration("groups-sync-interval", 10*time.Second, "how often to check groups-dir for changes")
+
+	etcdRequestTimeout = flagSet.Duration("etcd-request-timeout", etcd.ETCD_REQUEST_TIMEOUT, "timeout of a single etcd request")
+	etcdDialTimeout    = flagSet.Duration("etcd-dial-timeout", etcd.ETCD_DIAL_TIMEOUT, "timeout of connecting to an etcd member")
+	etcdAutoSync       = flagSet.Duration("etcd-auto-sync-interval", etcd.AUTO_SYNC_INTERVAL, "how often to refresh the etcd cluster member list")
+	reconcileInterval  = flagSet.Duration("reconcile-interval", etcd.RECONCILE_INTERVAL, "how often to reconcile groups and leaders with etcd")
+	watchRetryMin      = flagSet.Duration("watch-retry-min", etcd.WATCH_RETRY_MIN, "initial backoff after an etcd watch error")
+	watchRetryMax      = flagSet.Duration("watch-retry-max", etcd.WATCH_RETRY_MAX, "max backoff after repeated etcd watch errors")
+
+	heartbeatInterval  = flagSet.Duration("heartbeat-interval", etcd.HEARTBEAT_INTERVAL, "agent heartbeat interval, members go suspect after 3 and dead after 10 missed intervals")
+	memberHbTimeout    = flagSet.Duration("member-heartbeat-timeout", etcd.MEMBER_HEARTBEAT_TIMEOUT, "heartbeat age after which /members reports an untracked member unhealthy")
+	checkInterval      = flagSet.Duration("check-interval", etcd.CHECK_ALIVE_INTERVAL, "how often to probe the leader and retry failover")
+	checkConcurrency   = flagSet.Int("check-concurrency", etcd.CHECK_CONCURRENCY, "number of groups checked concurrently")
+	defaultGroupPolicy = flagSet.String("default-group-policy", "", "policy json for groups without a policy key, e.g. {\"probes\":[{\"type\":\"tcp\",\"port\":8080}]}")
+	execProbes         = flagSet.Bool("exec-probes", false, "run exec probes from group policies, anyone who can write the policy in etcd can then run commands on this host")
+
+	flapWindow         = flagSet.Duration("flap-window", etcd.FLAP_WINDOW, "window to count member transitions and group failovers")
+	flapThreshold      = flagSet.Int("flap-threshold", etcd.FLAP_THRESHOLD, "times a member leaves healthy within flap-window before it is quarantined")
+	flapQuarantineMin  = flagSet.Duration("flap-quarantine-min", etcd.FLAP_QUARANTINE_MIN, "first quarantine of a flapping member, doubled on each repeat")
+	flapQuarantineMax  = flagSet.Duration("flap-quarantine-max", etcd.FLAP_QUARANTINE_MAX, "max quarantine of a flapping member")
+	groupFlapThreshold = flagSet.Int("group-flap-threshold", etcd.GROUP_FLAP_THRESHOLD, "failovers within flap-window that damp the group")
+	groupDamping       = flagSet.Duration("group-damping", etcd.GROUP_DAMPING, "how long a damped group refuses failover")
+
+	schedulerWorkers    = flagSet.Int("scheduler-workers", etcd.SCHEDULER_WORKERS, "number of goroutines applying leader exchanges")
+	schedulerQueueLimit = flagSet.Int("scheduler-queue-limit", etcd.SCHEDULER_QUEUE_LIMIT, "max pending leader exchanges, new requests are dropped when full")
+
+	failoverMaxStale    = flagSet.Float64("failover-max-stale-fraction", etcd.FAILOVER_MAX_STALE_FRACTION, "refuse failover when more than this fraction of all members went stale at once")
+	guardPingInterval   = flagSet.Duration("guard-ping-interval", etcd.GUARD_PING_INTERVAL, "how often to ping etcd and check the local clock")
+	guardContactTimeout = flagSet.Duration("guard-contact-timeout", etcd.GUARD_CONTACT_TIMEOUT, "refuse failover when etcd has not answered for this long")
+	guardMaxFailures    = flagSet.Int("guard-max-failures", etcd.GUARD_MAX_FAILURES, "refuse failover after this many consecutive etcd errors")
+	massStaleWindow     = flagSet.Duration("mass-stale-window", etcd.MASS_STALE_WINDOW, "window to count members going stale at once")
+	massStaleMinMembers = flagSet.Int("mass-stale-min-members", etcd.MASS_STALE_MIN_MEMBERS, "min total members before failover-max-stale-fraction applies")
+	clockJumpTolerance  = flagSet.Duration("clock-jump-tolerance", etcd.CLOCK_JUMP_TOLERANCE, "wall clock drift or process pause treated as a clock jump")
+	clockSuspectPeriod  = flagSet.Duration("clock-suspect-period", etcd.CLOCK_SUSPECT_PERIOD, "how long failover stays disabled after a clock jump")
+
+	logLevel  = flagSet.String("log-level", "info", "default log level: debug, info, warn or error")
+	logLevels = flagSet.String("log-levels", "", "comma separated per component log levels overriding log-level, e.g. worker=debug,scheduler=warn")
+	logFormat = flagSet.String("log-format", "logfmt", "log output format: logfmt or json")
 )
 
 //程序封装
 type program struct {
-	appd *app.Appd
+	appd   *app.Appd
+	reload chan os.Signal
 }
 
 func (p *program) Init(env svc.Environment) error {
@@ -43,26 +106,59 @@ func (p *program) Start() error {
 		os.Exit(0)
 	}
 
+	opts, err := loadOptions()
+	if err != nil {
+		logger.Default().Error("load config failed", "error", err)
+		os.Exit(1)
+	}
+
+	//后台进程创建
+	daemon := app.New(opts)
+	daemon.Main()
+	daemon.SetConfigLoader(loadOptions)
+	p.appd = daemon
+
+	//收到SIGHUP时重新加载配置
+	p.reload = make(chan os.Signal, 1)
+	signal.Notify(p.reload, syscall.SIGHUP)
+	go func() {
+		for range p.reload {
+			if _, err := daemon.Reload(); err != nil {
+				opts.Logger.Named("app").Error("reload config failed", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+//读取配置文件并与命令行参数合并, 命令行中指定的参数优先
+//启动时与重新加载配置时都会调用
+func loadOptions() (*app.Options, error) {
 	var cfg map[string]interface{}
 	if *config != "" {
 		_, err := toml.DecodeFile(*config, &cfg)
 		if err != nil {
-			log.Fatalf("ERROR: failed to load config file %s - %s", *config, err.Error())
+			return nil, fmt.Errorf("failed to load config file %s - %s", *config, err)
 		}
 	}
 
 	opts := app.NewOptions()
+	if err := opts.CheckConfigKeys(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s - %s", *config, err)
+	}
 	options.Resolve(opts, flagSet, cfg)
-
-	//后台进程创建
-	daemon := app.New(opts)
-	daemon.Main()
-	p.appd = daemon
-	return nil
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config - %s", err)
+	}
+	return opts, nil
 }
 
 //程序停止
 func (p *program) Stop() error {
+	if p.reload != nil {
+		signal.Stop(p.reload)
+		close(p.reload)
+	}
 	if p.appd != nil {
 		p.appd.Exit()
 	}
@@ -71,8 +167,23 @@ func (p *program) Stop() error {
 
 //引导程序
 func main() {
+	//子命令
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			os.Exit(bench.Main(os.Args[2:]))
+		case "ctl":
+			os.Exit(ctl.Main(os.Args[2:]))
+		case "doctor":
+			os.Exit(doctor.Main(os.Args[2:]))
+		case "snapshot":
+			os.Exit(snapshot.Main(os.Args[2:]))
+		}
+	}
+
 	prg := &program{}
 	if err := svc.Run(prg, syscall.SIGINT, syscall.SIGTERM); err != nil {
-		log.Fatal(err)
+		logger.Default().Error("run failed", "error", err)
+		os.Exit(1)
 	}
 }
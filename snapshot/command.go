@@ -0,0 +1,148 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/domac/hasky/etcd"
+	"github.com/domac/hasky/logger"
+	"io"
+	"os"
+)
+
+//hasky snapshot 子命令, 直接连接etcd导出或导入快照, 返回进程退出码
+//  hasky snapshot export [-o file] [-heartbeats] [-include-secrets]
+//  hasky snapshot import [-conflict skip|overwrite|fail] [-dry-run] <file|->
+func Main(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: hasky snapshot export|import [flags]")
+		return 2
+	}
+	switch args[0] {
+	case "export":
+		return exportCommand(args[1:])
+	case "import":
+		return importCommand(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "snapshot: unknown command %q, must be export or import\n", args[0])
+	return 2
+}
+
+func exportCommand(args []string) int {
+	flagSet := flag.NewFlagSet("hasky snapshot export", flag.ExitOnError)
+	etcdFlags := etcd.NewClientFlags(flagSet)
+	output := flagSet.String("o", "-", "output file, - for stdout")
+	heartbeats := flagSet.Bool("heartbeats", false, "include member heartbeats")
+	secrets := flagSet.Bool("include-secrets", false, "include keys holding API tokens, anyone with the file can use them")
+	flagSet.Parse(args)
+
+	logger.Default().SetLevel(logger.ERROR)
+	namespaces, err := etcdFlags.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+	snap, err := etcd.ExportSnapshot(etcd.GetClient(), namespaces.Prefix(), *heartbeats, *secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: export %s failed: %v\n", namespaces.Prefix(), err)
+		return 1
+	}
+
+	if err := writeSnapshot(snap, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "exported %d keys from %s\n", len(snap.Keys), namespaces.Prefix())
+	if len(snap.Excluded) > 0 {
+		fmt.Fprintf(os.Stderr, "left out %d keys holding API tokens, use -include-secrets to export them\n", len(snap.Excluded))
+	}
+	return 0
+}
+
+//以json写入快照, output为 - 时写到标准输出
+func writeSnapshot(snap *etcd.Snapshot, output string) error {
+	var out io.Writer = os.Stdout
+	var f *os.File
+	if output != "-" {
+		var err error
+		if f, err = os.Create(output); err != nil {
+			return err
+		}
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(snap); err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}
+	if f != nil {
+		//写入的错误可能在关闭时才返回, 例如磁盘已满
+		return f.Close()
+	}
+	return nil
+}
+
+func importCommand(args []string) int {
+	flagSet := flag.NewFlagSet("hasky snapshot import", flag.ExitOnError)
+	etcdFlags := etcd.NewClientFlags(flagSet)
+	conflictFlag := flagSet.String("conflict", string(etcd.CONFLICT_SKIP), "how to handle existing keys with different values: skip, overwrite or fail")
+	dryRun := flagSet.Bool("dry-run", false, "print what would change without writing")
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: hasky snapshot import [flags] <file|->")
+		return 2
+	}
+	conflict, err := etcd.ParseConflictPolicy(*conflictFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 2
+	}
+	var in io.Reader = os.Stdin
+	if name := flagSet.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+	snap, err := etcd.ReadSnapshot(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+
+	logger.Default().SetLevel(logger.ERROR)
+	namespaces, err := etcdFlags.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+	result, err := etcd.ImportSnapshot(etcd.GetClient(), namespaces.Prefix(), snap, conflict, *dryRun)
+	if result != nil {
+		PrintResult(os.Stdout, result)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+//输出导入结果, ctl也使用该格式
+func PrintResult(out io.Writer, result *etcd.ImportResult) {
+	for _, c := range result.Conflicts {
+		fmt.Fprintf(out, "conflict: %s\n", c)
+	}
+	prefix := ""
+	if result.DryRun {
+		prefix = "dry run: "
+	}
+	fmt.Fprintf(out, "%s%d created, %d updated, %d unchanged, %d skipped\n",
+		prefix, result.Created, result.Updated, result.Unchanged, result.Skipped)
+}